@@ -0,0 +1,144 @@
+package lmq
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrReplierClosed = errors.New("lmq: replier closed")
+
+// BatchReplier is implemented by clients which can send several replies in
+// one request. AsyncReplier uses it if the client implements it. The returned
+// slice holds the error of each reply.
+type BatchReplier interface {
+	ReplyBatch([]*Message, []ReplyType) []error
+}
+
+type asyncReply struct {
+	m    *Message
+	r    ReplyType
+	done func(error)
+}
+
+// AsyncReplier sends replies in the background so that consumers need not
+// wait for a request per reply. At most Concurrency replies, or batches of up
+// to MaxBatch replies if Client is a BatchReplier, are in flight at a time.
+type AsyncReplier struct {
+	Client      Client
+	Concurrency int
+	MaxBatch    int
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan *asyncReply
+	wg     sync.WaitGroup
+}
+
+// NewAsyncReplier starts concurrency senders which take replies from a queue
+// of size queueSize.
+func NewAsyncReplier(c Client, concurrency, queueSize int) *AsyncReplier {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	a := &AsyncReplier{
+		Client:      c,
+		Concurrency: concurrency,
+		MaxBatch:    100,
+		ch:          make(chan *asyncReply, queueSize),
+	}
+	a.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go a.run()
+	}
+	return a
+}
+
+// ReplyAsync queues reply r to m, waiting if the queue is full. done, if not
+// nil, is called with the result of the reply from a sender goroutine.
+func (a *AsyncReplier) ReplyAsync(m *Message, r ReplyType, done func(error)) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return ErrReplierClosed
+	}
+	a.ch <- &asyncReply{m: m, r: r, done: done}
+	return nil
+}
+
+// Close sends the queued replies and waits for them to complete.
+func (a *AsyncReplier) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrReplierClosed
+	}
+	a.closed = true
+	close(a.ch)
+	a.mu.Unlock()
+	a.wg.Wait()
+	return nil
+}
+
+func (a *AsyncReplier) run() {
+	defer a.wg.Done()
+	br, batch := a.Client.(BatchReplier)
+	for ar := range a.ch {
+		if !batch {
+			ar.complete(a.Client.Reply(ar.m, ar.r))
+			continue
+		}
+		a.sendBatch(br, a.collect(ar))
+	}
+}
+
+// collect takes the replies already queued after first, up to MaxBatch.
+func (a *AsyncReplier) collect(first *asyncReply) []*asyncReply {
+	ars := []*asyncReply{first}
+	for len(ars) < a.MaxBatch {
+		select {
+		case ar, ok := <-a.ch:
+			if !ok {
+				return ars
+			}
+			ars = append(ars, ar)
+		default:
+			return ars
+		}
+	}
+	return ars
+}
+
+// sendBatch tracks the replies like Client.Reply does; messages already
+// replied to are left out of the batch.
+func (a *AsyncReplier) sendBatch(br BatchReplier, ars []*asyncReply) {
+	var (
+		ms      []*Message
+		rs      []ReplyType
+		pending []*asyncReply
+	)
+	for _, ar := range ars {
+		if err := ar.m.beginReply(ar.r); err != nil {
+			ar.complete(err)
+			continue
+		}
+		ms, rs, pending = append(ms, ar.m), append(rs, ar.r), append(pending, ar)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	errs := br.ReplyBatch(ms, rs)
+	for i, ar := range pending {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		}
+		ar.m.endReply(ar.r, err)
+		ar.complete(err)
+	}
+}
+
+func (ar *asyncReply) complete(err error) {
+	if ar.done != nil {
+		ar.done(err)
+	}
+}
@@ -0,0 +1,129 @@
+package lmq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncReplier(t *testing.T) {
+	queue := "TestAsyncReplier"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	var ms []*Message
+	for i := 0; i < 20; i++ {
+		_, err := c.Push(queue, "text/plain", strings.NewReader(fmt.Sprint(i)))
+		must(t, err)
+		m, err := c.Pull(queue, 0)
+		must(t, err)
+		ms = append(ms, m)
+	}
+
+	a := NewAsyncReplier(c, 4, 5)
+	var ok, failed int32
+	done := func(err error) {
+		if err != nil {
+			atomic.AddInt32(&failed, 1)
+		} else {
+			atomic.AddInt32(&ok, 1)
+		}
+	}
+	for _, m := range ms {
+		must(t, a.ReplyAsync(m, ReplyAck, done))
+	}
+	must(t, a.ReplyAsync(&Message{Queue: queue, ID: "unknown"}, ReplyAck, done))
+	assert.Nil(t, a.Close())
+	assert.Equal(t, int32(20), ok)
+	assert.Equal(t, int32(1), failed)
+	for _, m := range ms {
+		assert.True(t, m.Replied())
+	}
+	_, err := c.Pull(queue, 0)
+	assert.True(t, isEmpty(err))
+
+	assert.Equal(t, ErrReplierClosed, a.ReplyAsync(ms[0], ReplyAck, nil))
+	assert.Equal(t, ErrReplierClosed, a.Close())
+}
+
+type concurrencyClient struct {
+	Client
+	cur, max int32
+}
+
+func (c *concurrencyClient) Reply(m *Message, r ReplyType) error {
+	n := atomic.AddInt32(&c.cur, 1)
+	defer atomic.AddInt32(&c.cur, -1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+func TestAsyncReplierConcurrency(t *testing.T) {
+	c := &concurrencyClient{}
+	a := NewAsyncReplier(c, 3, 0)
+	for i := 0; i < 30; i++ {
+		must(t, a.ReplyAsync(&Message{}, ReplyAck, nil))
+	}
+	a.Close()
+	assert.Equal(t, int32(3), c.max)
+}
+
+type batchClient struct {
+	Client
+	gate    chan struct{}
+	mu      sync.Mutex
+	batches [][]ReplyType
+}
+
+func (c *batchClient) ReplyBatch(ms []*Message, rs []ReplyType) []error {
+	<-c.gate
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches = append(c.batches, rs)
+	return make([]error, len(ms))
+}
+
+func TestAsyncReplierBatch(t *testing.T) {
+	c := &batchClient{gate: make(chan struct{})}
+	a := NewAsyncReplier(c, 1, 10)
+	a.MaxBatch = 4
+	ms := make([]*Message, 10)
+	for i := range ms {
+		ms[i] = &Message{}
+		must(t, a.ReplyAsync(ms[i], ReplyType(i%2), nil))
+	}
+	// The first batch is blocked until the rest have been queued.
+	close(c.gate)
+	a.Close()
+
+	n := 0
+	for _, b := range c.batches {
+		assert.True(t, len(b) <= 4)
+		n += len(b)
+	}
+	assert.Equal(t, 10, n)
+	assert.True(t, len(c.batches) < 10)
+	for _, m := range ms {
+		assert.True(t, m.Replied())
+	}
+
+	// Replied messages are left out of batches.
+	a = NewAsyncReplier(c, 1, 1)
+	var err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	a.ReplyAsync(ms[0], ReplyAck, func(e error) { err = e; wg.Done() })
+	wg.Wait()
+	a.Close()
+	assert.Equal(t, ErrReplied, err)
+}
@@ -0,0 +1,193 @@
+package lmq
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds credentials to each request sent by a client. It is
+// called after the URL of the request is final.
+type Authenticator interface {
+	Authenticate(*http.Request) error
+}
+
+// Refresher is implemented by authenticators whose credentials can be
+// refreshed. A client refreshes them and retries once when a request is
+// answered with 401 Unauthorized.
+type Refresher interface {
+	Refresh() error
+}
+
+// WithAuth authenticates the requests of the client by a.
+func WithAuth(a Authenticator) Option {
+	return func(c *client) {
+		c.auth = a
+	}
+}
+
+// BasicAuth authenticates by HTTP basic authentication.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuth) Authenticate(r *http.Request) error {
+	r.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// BearerToken authenticates by a static bearer token.
+type BearerToken string
+
+func (t BearerToken) Authenticate(r *http.Request) error {
+	r.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// TokenSource fetches a token.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+type TokenSourceFunc func() (string, error)
+
+func (f TokenSourceFunc) Token() (string, error) {
+	return f()
+}
+
+// TokenFile reads a token from the file at path, which is typically rotated
+// by an agent.
+func TokenFile(path string) TokenSource {
+	return TokenSourceFunc(func() (string, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	})
+}
+
+// TokenCommand runs name with args and takes its standard output as a token.
+func TokenCommand(name string, args ...string) TokenSource {
+	return TokenSourceFunc(func() (string, error) {
+		b, err := exec.Command(name, args...).Output()
+		if err != nil {
+			return "", fmt.Errorf("lmq: token command: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	})
+}
+
+// RefreshingToken authenticates by bearer tokens from Source. A token is
+// reused for TTL, or until the server rejects it; zero TTL means until
+// rejected.
+type RefreshingToken struct {
+	Source TokenSource
+	TTL    time.Duration
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+}
+
+func NewRefreshingToken(src TokenSource, ttl time.Duration) *RefreshingToken {
+	return &RefreshingToken{Source: src, TTL: ttl}
+}
+
+func (t *RefreshingToken) Authenticate(r *http.Request) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == "" || t.TTL > 0 && time.Since(t.fetched) >= t.TTL {
+		if err := t.fetch(); err != nil {
+			return err
+		}
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return nil
+}
+
+func (t *RefreshingToken) Refresh() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fetch()
+}
+
+func (t *RefreshingToken) fetch() error {
+	token, err := t.Source.Token()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("lmq: empty token")
+	}
+	t.token, t.fetched = token, time.Now()
+	return nil
+}
+
+// HMACAuthScheme is the scheme of the Authorization header set by HMACAuth.
+const HMACAuthScheme = "LMQ-HMAC-SHA256"
+
+// HMACAuth signs requests with a shared key. The Authorization header is
+//
+//	LMQ-HMAC-SHA256 key=<KeyID>, ts=<unix seconds>, sig=<base64 signature>
+//
+// where the signature is the HMAC-SHA256 of the method, the escaped request
+// target (path and query), the timestamp and the hex SHA-256 of the body,
+// joined by newlines.
+type HMACAuth struct {
+	KeyID string
+	Key   []byte
+}
+
+func (a *HMACAuth) Authenticate(r *http.Request) error {
+	body, err := requestBody(r)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := a.Sign(r.Method, r.URL.RequestURI(), ts, body)
+	r.Header.Set("Authorization", fmt.Sprintf("%s key=%s, ts=%s, sig=%s", HMACAuthScheme, a.KeyID, ts, sig))
+	return nil
+}
+
+// Sign returns the signature of a request, so that servers can verify it.
+func (a *HMACAuth) Sign(method, target, ts string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, a.Key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, target, ts, hex.EncodeToString(sum[:]))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestBody returns the body of r, leaving r readable again.
+func requestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.GetBody != nil {
+		rc, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
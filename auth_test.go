@@ -0,0 +1,110 @@
+package lmq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func authServer(check func(r *http.Request, body []byte) bool) (*httptest.Server, *int32) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		if !check(r, b) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"accum":"no"}`))
+	}))
+	return s, &requests
+}
+
+func TestBasicAuth(t *testing.T) {
+	s, _ := authServer(func(r *http.Request, _ []byte) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "user" && pass == "pass"
+	})
+	defer s.Close()
+	_, err := New(s.URL, WithAuth(&BasicAuth{"user", "pass"})).Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	_, err = New(s.URL, WithAuth(&BasicAuth{"user", "wrong"})).Push("q", "text/plain", strings.NewReader("x"))
+	assert.Equal(t, http.StatusUnauthorized, err.(*Error).Code)
+}
+
+func TestBearerToken(t *testing.T) {
+	s, _ := authServer(func(r *http.Request, _ []byte) bool {
+		return r.Header.Get("Authorization") == "Bearer secret"
+	})
+	defer s.Close()
+	_, err := New(s.URL, WithAuth(BearerToken("secret"))).Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+}
+
+func TestRefreshingToken(t *testing.T) {
+	var valid atomic.Value
+	valid.Store("t2")
+	s, requests := authServer(func(r *http.Request, body []byte) bool {
+		return r.Header.Get("Authorization") == "Bearer "+valid.Load().(string) && string(body) == "x"
+	})
+	defer s.Close()
+	var fetched int32
+	auth := NewRefreshingToken(TokenSourceFunc(func() (string, error) {
+		return fmt.Sprintf("t%d", atomic.AddInt32(&fetched, 1)), nil
+	}), 0)
+	c := New(s.URL, WithAuth(auth))
+
+	// t1 is rejected, so t2 is fetched and the request is retried with the
+	// same body.
+	_, err := c.Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+	_, err = c.Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetched))
+
+	// It is retried only once.
+	valid.Store("never")
+	_, err = c.Push("q", "text/plain", strings.NewReader("x"))
+	assert.Equal(t, http.StatusUnauthorized, err.(*Error).Code)
+	assert.Equal(t, int32(5), atomic.LoadInt32(requests))
+}
+
+func TestTokenSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	must(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+	token, err := TokenFile(path).Token()
+	must(t, err)
+	assert.Equal(t, "from-file", token)
+
+	token, err = TokenCommand("echo", "from-command").Token()
+	must(t, err)
+	assert.Equal(t, "from-command", token)
+
+	_, err = TokenCommand("false").Token()
+	assert.NotNil(t, err)
+}
+
+func TestHMACAuth(t *testing.T) {
+	auth := &HMACAuth{KeyID: "k1", Key: []byte("key")}
+	s, _ := authServer(func(r *http.Request, body []byte) bool {
+		var key, ts, sig string
+		fmt.Sscanf(strings.Replace(r.Header.Get("Authorization"), ",", "", -1), HMACAuthScheme+" key=%s ts=%s sig=%s", &key, &ts, &sig)
+		return key == "k1" && r.URL.EscapedPath() == "/messages/a%2Fb" &&
+			sig == auth.Sign(r.Method, r.URL.RequestURI(), ts, body)
+	})
+	defer s.Close()
+	_, err := New(s.URL, WithAuth(auth)).Push("a/b", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	_, err = New(s.URL, WithAuth(&HMACAuth{KeyID: "k1", Key: []byte("other")})).Push("a/b", "text/plain", strings.NewReader("x"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package lmq
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("lmq: circuit open")
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	panic("unreach")
+}
+
+// CircuitBreaker stops sending requests to LMQ after Threshold consecutive
+// transport failures or 5xx responses, failing fast with ErrCircuitOpen
+// instead. After Cooldown, up to Probes requests are let through; the circuit
+// closes if one succeeds and opens again if one fails. OnStateChange, if set,
+// is called on each transition, e.g. to switch producers to a local spool.
+type CircuitBreaker struct {
+	Threshold     int
+	Cooldown      time.Duration
+	Probes        int
+	OnStateChange func(from, to CircuitState)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, Probes: 1}
+}
+
+// WithCircuitBreaker guards the requests of the client by b.
+func WithCircuitBreaker(b *CircuitBreaker) Option {
+	return func(c *client) {
+		c.breaker = b
+	}
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a request may be sent. Every allowed request must be
+// followed by Record.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	from := b.state
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.Cooldown {
+		b.state, b.probes = CircuitHalfOpen, 0
+	}
+	allowed := true
+	switch b.state {
+	case CircuitOpen:
+		allowed = false
+	case CircuitHalfOpen:
+		if allowed = b.probes < b.Probes; allowed {
+			b.probes++
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	if !allowed {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Record records the result of a request allowed by Allow.
+func (b *CircuitBreaker) Record(resp *http.Response, err error) {
+	failed := err != nil || resp.StatusCode >= 500
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case !failed:
+		b.state, b.failures = CircuitClosed, 0
+	case b.state == CircuitHalfOpen:
+		b.state, b.openedAt = CircuitOpen, time.Now()
+	case b.state == CircuitClosed:
+		if b.failures++; b.failures >= b.Threshold {
+			b.state, b.openedAt = CircuitOpen, time.Now()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+func (b *CircuitBreaker) notify(from, to CircuitState) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
@@ -0,0 +1,65 @@
+package lmq
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var fail int32 = 1
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"accum":"no"}`))
+	}))
+	defer s.Close()
+
+	var transitions []string
+	b := NewCircuitBreaker(2, 50*time.Millisecond)
+	b.OnStateChange = func(from, to CircuitState) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	}
+	c := New(s.URL, WithCircuitBreaker(b))
+	push := func() error {
+		_, err := c.Push("q", "text/plain", strings.NewReader("x"))
+		return err
+	}
+
+	assert.IsType(t, &Error{}, push())
+	assert.IsType(t, &Error{}, push())
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.Equal(t, ErrCircuitOpen, push())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.IsType(t, &Error{}, push())
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.Equal(t, ErrCircuitOpen, push())
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&fail, 0)
+	assert.Nil(t, push())
+	assert.Equal(t, CircuitClosed, b.State())
+	assert.Equal(t, []string{
+		"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed",
+	}, transitions)
+}
+
+func TestCircuitBreakerTransportError(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute)
+	c := New("http://127.0.0.1:1", WithCircuitBreaker(b))
+	_, err := c.Pull("q", 0)
+	assert.NotEqual(t, ErrCircuitOpen, err)
+	_, err = c.Pull("q", 0)
+	assert.Equal(t, ErrCircuitOpen, err)
+}
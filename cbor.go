@@ -0,0 +1,38 @@
+package lmq
+
+import (
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var (
+	cborDec cbor.DecMode
+	cborEnc cbor.EncMode
+)
+
+func cborDecoder(b []byte, v interface{}) error {
+	return cborDec.Unmarshal(b, v)
+}
+
+func cborEncoder(v interface{}) ([]byte, error) {
+	return cborEnc.Marshal(v)
+}
+
+func init() {
+	var err error
+	// Decode maps into the same type as msgpack does for interface{} values.
+	cborDec, err = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	if cborEnc, err = cbor.CanonicalEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+	for _, ct := range []string{"application/cbor", "+cbor"} {
+		RegisterDecoder(ct, DecoderFunc(cborDecoder))
+		RegisterEncoder(ct, EncoderFunc(cborEncoder))
+	}
+}
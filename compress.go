@@ -0,0 +1,134 @@
+package lmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingParam is the content type parameter which records the compression
+// applied to a message body. A content type parameter is used instead of the
+// Content-Encoding header because LMQ preserves the content type only.
+const EncodingParam = "content-encoding"
+
+// MaxDecompressedSize limits the size of a decompressed message body to guard
+// against decompression bombs. The memory of the shared zstd decoder is
+// limited by its initial value.
+var MaxDecompressedSize int64 = 64 << 20
+
+var (
+	ErrUnknownEncoding = errors.New("lmq: unknown content encoding")
+	ErrTooLarge        = errors.New("lmq: decompressed message too large")
+)
+
+type compressor struct {
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+}
+
+var compressors = map[string]compressor{
+	"gzip": {gzipCompress, gzipDecompress},
+	"zstd": {zstdCompress, zstdDecompress},
+}
+
+// The zstd encoder and decoder are shared since they are expensive to create;
+// EncodeAll and DecodeAll are safe for concurrent use.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(uint64(MaxDecompressedSize)))
+)
+
+// WithCompression makes the client compress push bodies with encoding, which
+// is either "gzip" or "zstd". Pulled messages are decompressed regardless of
+// this option.
+func WithCompression(encoding string) Option {
+	return func(c *client) {
+		c.encoding = encoding
+	}
+}
+
+// compressBody compresses body with encoding and records it in ct. A body whose
+// ct already records an encoding, such as the body of a pulled message pushed
+// again, is passed through unchanged, as is a body whose ct is empty or cannot
+// be parsed and so cannot record an encoding.
+func compressBody(encoding, ct string, body io.Reader) (string, io.Reader, error) {
+	comp, ok := compressors[encoding]
+	if !ok {
+		return "", nil, ErrUnknownEncoding
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil || params[EncodingParam] != "" {
+		return ct, body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", nil, err
+	}
+	if b, err = comp.compress(b); err != nil {
+		return "", nil, err
+	}
+	params[EncodingParam] = encoding
+	return mime.FormatMediaType(mt, params), bytes.NewReader(b), nil
+}
+
+// decompressBody reverses compressBody. ct and b are returned as they are if ct
+// has no encoding parameter.
+func decompressBody(ct string, b []byte) (string, []byte, error) {
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil || params[EncodingParam] == "" {
+		return ct, b, nil
+	}
+	comp, ok := compressors[params[EncodingParam]]
+	if !ok {
+		return "", nil, ErrUnknownEncoding
+	}
+	if b, err = comp.decompress(b); err != nil {
+		return "", nil, err
+	}
+	if int64(len(b)) > MaxDecompressedSize {
+		return "", nil, ErrTooLarge
+	}
+	delete(params, EncodingParam)
+	return mime.FormatMediaType(mt, params), b, nil
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipDecompress reads at most one byte more than MaxDecompressedSize.
+func gzipDecompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+}
+
+func zstdCompress(b []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(b, nil), nil
+}
+
+func zstdDecompress(b []byte) ([]byte, error) {
+	b, err := zstdDecoder.DecodeAll(b, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrTooLarge
+	}
+	return b, err
+}
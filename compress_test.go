@@ -0,0 +1,99 @@
+package lmq
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	for _, enc := range []string{"gzip", "zstd"} {
+		queue := "TestCompression:" + enc
+		c := New(lmqURL, WithCompression(enc))
+		defer c.Delete(queue)
+
+		body := `{"ID":1}`
+		_, err := c.Push(queue, "application/json; charset=utf-8", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := c.Pull(queue, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "application/json; charset=utf-8; content-encoding="+enc, m.ContentType)
+		assert.NotEqual(t, body, string(m.Body))
+		var v struct{ ID int }
+		assert.Nil(t, m.Decode(&v))
+		assert.Equal(t, 1, v.ID)
+		assert.Nil(t, c.Reply(m, ReplyAck))
+	}
+
+	_, err := New(lmqURL, WithCompression("br")).Push("TestCompression", "text/plain", strings.NewReader(""))
+	assert.Equal(t, ErrUnknownEncoding, err)
+}
+
+func TestCompressedCompoundPart(t *testing.T) {
+	ct, r, err := compressBody("zstd", "text/plain", strings.NewReader("part"))
+	must(t, err)
+	var part bytes.Buffer
+	part.ReadFrom(r)
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": ct}, part.Bytes()},
+	})
+	must(t, err)
+
+	m := &Message{MessageType: "compound", Body: body}
+	var s interface{}
+	must(t, m.Decode(&s))
+	assert.Equal(t, "part", s)
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	defer func(n int64) { MaxDecompressedSize = n }(MaxDecompressedSize)
+	MaxDecompressedSize = 1024
+
+	for _, enc := range []string{"gzip", "zstd"} {
+		ct, r, err := compressBody(enc, "text/plain", strings.NewReader(strings.Repeat("a", 1025)))
+		must(t, err)
+		var b bytes.Buffer
+		b.ReadFrom(r)
+		m := &Message{MessageType: "normal", ContentType: ct, Body: b.Bytes()}
+		var s interface{}
+		assert.Equal(t, ErrTooLarge, m.Decode(&s), enc)
+	}
+}
+
+func TestCompressionKeepsContentType(t *testing.T) {
+	for _, ct := range []string{"", "not a media type;"} {
+		got, r, err := compressBody("zstd", ct, strings.NewReader("x"))
+		must(t, err)
+		assert.Equal(t, ct, got)
+		var b bytes.Buffer
+		b.ReadFrom(r)
+		assert.Equal(t, "x", b.String())
+	}
+}
+
+func TestCompressionRepush(t *testing.T) {
+	queue, dlq := "TestCompressionRepush", "TestCompressionRepush:dead"
+	c := New(lmqURL, WithCompression("gzip"))
+	defer c.Delete(queue)
+	defer c.Delete(dlq)
+
+	_, err := c.Push(queue, "text/plain", strings.NewReader("hello"))
+	must(t, err)
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	must(t, DeadLetterHandler(c, dlq).HandleMessage(context.Background(), m))
+
+	m, err = c.Pull(dlq, 0)
+	must(t, err)
+	assert.Equal(t, "text/plain; content-encoding=gzip", m.ContentType)
+	var v interface{}
+	must(t, m.Decode(&v))
+	assert.Equal(t, "hello", v)
+}
@@ -0,0 +1,259 @@
+package lmq
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyParam is the content type parameter, or the metadata key,
+// carrying a key supplied by the producer to identify duplicates of a message.
+const IdempotencyKeyParam = "idempotency-key"
+
+// DedupKey returns the idempotency key of m if the producer supplied one, and
+// the message ID otherwise. Either is prefixed by the queue name, so that
+// copies of a message pushed to several queues by PushAll are processed once
+// per queue.
+func DedupKey(m *Message) string {
+	key := contentTypeParam(m.ContentType, IdempotencyKeyParam)
+	if key == "" {
+		key = m.GetMeta(IdempotencyKeyParam)
+	}
+	if key == "" {
+		key = m.ID
+	}
+	return m.Queue + "/" + key
+}
+
+// DedupStore remembers the keys of processed messages.
+type DedupStore interface {
+	Contains(key string) (bool, error)
+	Add(key string) error
+}
+
+// Deduplicator skips messages which have already been processed. Since
+// messages are redelivered after nack or timeout, a handler may otherwise see
+// the same message more than once.
+type Deduplicator struct {
+	Client Client
+	Store  DedupStore
+	Key    func(*Message) string
+}
+
+func NewDeduplicator(c Client, s DedupStore) *Deduplicator {
+	return &Deduplicator{Client: c, Store: s, Key: DedupKey}
+}
+
+// Handle acks m without calling fn if m is a duplicate. Otherwise it replies
+// to m with the result of fn and remembers m if it was acked.
+func (d *Deduplicator) Handle(m *Message, fn func(*Message) ReplyType) error {
+	key := d.Key(m)
+	dup, err := d.Store.Contains(key)
+	if err != nil {
+		return err
+	}
+	if dup {
+		return d.Client.Reply(m, ReplyAck)
+	}
+	r := fn(m)
+	if r == ReplyAck {
+		if err := d.Store.Add(key); err != nil {
+			return err
+		}
+	}
+	return d.Client.Reply(m, r)
+}
+
+// Middleware returns the middleware form of d. See Dedup.
+func (d *Deduplicator) Middleware() Middleware {
+	return Dedup(d.Store, d.Key)
+}
+
+// MemoryDedupStore keeps up to size keys in memory for ttl. The least recently
+// added keys are evicted first.
+type MemoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryDedupStore) Contains(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(e.Value.(*dedupEntry).expires) {
+		s.remove(e)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Add(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+	s.items[key] = s.ll.PushFront(&dedupEntry{key: key, expires: time.Now().Add(s.ttl)})
+	for s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) remove(e *list.Element) {
+	s.ll.Remove(e)
+	delete(s.items, e.Value.(*dedupEntry).key)
+}
+
+// FileDedupStore keeps keys for ttl in an append-only file, so that they
+// survive restarts. The file is compacted when expired keys dominate it.
+type FileDedupStore struct {
+	mu    sync.Mutex
+	path  string
+	ttl   time.Duration
+	f     *os.File
+	keys  map[string]time.Time
+	lines int
+}
+
+// OpenFileDedupStore opens or creates the store at path.
+func OpenFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	s := &FileDedupStore{path: path, ttl: ttl, keys: make(map[string]time.Time)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// load reads lines of the form "<expiry in unix nanoseconds> <quoted key>".
+// A torn last line left by a crash is ignored.
+func (s *FileDedupStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		s.lines++
+		parts := strings.SplitN(sc.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		key, err := strconv.Unquote(parts[1])
+		if err != nil {
+			continue
+		}
+		if expires := time.Unix(0, n); expires.After(now) {
+			s.keys[key] = expires
+		}
+	}
+	return sc.Err()
+}
+
+func (s *FileDedupStore) Contains(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.keys[key]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *FileDedupStore) Add(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(s.ttl)
+	if _, err := fmt.Fprintf(s.f, "%d %s\n", expires.UnixNano(), strconv.Quote(key)); err != nil {
+		return err
+	}
+	s.keys[key] = expires
+	s.lines++
+	if s.lines > 2*len(s.keys)+1024 {
+		return s.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the file with unexpired keys only.
+func (s *FileDedupStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *FileDedupStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := time.Now()
+	for key, expires := range s.keys {
+		if expires.Before(now) {
+			delete(s.keys, key)
+			continue
+		}
+		fmt.Fprintf(w, "%d %s\n", expires.UnixNano(), strconv.Quote(key))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.f.Close()
+	if s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	s.lines = len(s.keys)
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,117 @@
+package lmq
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	queue := "TestDeduplicator"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	d := NewDeduplicator(c, NewMemoryDedupStore(10, time.Minute))
+
+	for _, body := range []string{"first", "second", "third"} {
+		ct := "text/plain; idempotency-key=k1"
+		if body == "third" {
+			ct = "text/plain; idempotency-key=k2"
+		}
+		if _, err := c.Push(queue, ct, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var handled []string
+	results := []ReplyType{ReplyNack, ReplyAck, ReplyAck, ReplyAck}
+	for i := 0; i < 4; i++ {
+		m, err := c.Pull(queue, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Handle(m, func(m *Message) ReplyType {
+			handled = append(handled, string(m.Body))
+			return results[len(handled)-1]
+		})
+		assert.Nil(t, err)
+	}
+	// "first" is nacked and redelivered after the others, so it is skipped
+	// once "second" with the same key has been acked.
+	assert.Equal(t, []string{"first", "second", "third"}, handled)
+	_, err := c.Pull(queue, 0)
+	assert.True(t, isEmpty(err))
+}
+
+func TestDedupKey(t *testing.T) {
+	queues := []string{"TestDedupKey:1", "TestDedupKey:2"}
+	c := New(lmqURL)
+	for _, q := range queues {
+		c.Pull(q, 0)
+		defer c.Delete(q)
+	}
+	d := NewDeduplicator(c, NewMemoryDedupStore(10, time.Minute))
+
+	_, err := c.PushAll("^TestDedupKey:", "text/plain; idempotency-key=k", strings.NewReader("x"))
+	must(t, err)
+	_, err = PushWithMeta(c, queues[0], "text/plain", map[string]string{IdempotencyKeyParam: "m"}, strings.NewReader("y"))
+	must(t, err)
+
+	var handled []string
+	for _, q := range []string{queues[0], queues[1], queues[0]} {
+		m, err := c.Pull(q, 0)
+		must(t, err)
+		must(t, d.Handle(m, func(m *Message) ReplyType {
+			handled = append(handled, m.Queue+":"+string(m.Body))
+			return ReplyAck
+		}))
+	}
+	assert.Equal(t, []string{"TestDedupKey:1:x", "TestDedupKey:2:x", "TestDedupKey:1:y"}, handled)
+
+	m := &Message{Queue: "q", ID: "id", Metadata: Metadata{Meta: map[string]string{IdempotencyKeyParam: "m"}}}
+	assert.Equal(t, "q/m", DedupKey(m))
+	m.ContentType = "text/plain; idempotency-key=p"
+	assert.Equal(t, "q/p", DedupKey(m))
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	s := NewMemoryDedupStore(2, time.Minute)
+	s.Add("a")
+	s.Add("b")
+	s.Add("c")
+	ok, _ := s.Contains("a")
+	assert.False(t, ok)
+	ok, _ = s.Contains("c")
+	assert.True(t, ok)
+
+	s = NewMemoryDedupStore(2, -time.Second)
+	s.Add("a")
+	ok, _ = s.Contains("a")
+	assert.False(t, ok)
+}
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := OpenFileDedupStore(path, time.Minute)
+	must(t, err)
+	must(t, s.Add("a"))
+	must(t, s.Add("key with\nnewline"))
+	must(t, s.Close())
+
+	s, err = OpenFileDedupStore(path, time.Minute)
+	must(t, err)
+	defer s.Close()
+	for _, key := range []string{"a", "key with\nnewline"} {
+		ok, err := s.Contains(key)
+		must(t, err)
+		assert.True(t, ok)
+	}
+	ok, _ := s.Contains("b")
+	assert.False(t, ok)
+
+	must(t, s.Compact())
+	ok, _ = s.Contains("a")
+	assert.True(t, ok)
+}
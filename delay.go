@@ -0,0 +1,200 @@
+package lmq
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"mime"
+	"strconv"
+	"time"
+)
+
+// Content type parameters of messages parked in the holding queue.
+const (
+	DeliverAtParam = "deliver-at"
+	TargetParam    = "target"
+)
+
+var DefaultHoldingQueue = "lmq-delayed"
+
+// Scheduler delivers messages at a specified time. LMQ has no native delay,
+// so messages are parked in HoldingQueue with their delivery time and target
+// queue recorded in the content type, and pushed to the target queue by Run
+// once they are due. Since all state lives in LMQ, pending messages survive
+// restarts of the process running Run.
+//
+// Messages due within MaxWait are held until they are due, extending their
+// timeout every ExtendInterval. Others are nacked; once all messages in the
+// holding queue have been seen, Run sleeps until the earliest one is due or
+// for at most MaxBackoff.
+type Scheduler struct {
+	Client         Client
+	HoldingQueue   string
+	PollTimeout    time.Duration
+	MaxWait        time.Duration
+	ExtendInterval time.Duration
+	MaxBackoff     time.Duration
+}
+
+func NewScheduler(c Client) *Scheduler {
+	return &Scheduler{
+		Client:         c,
+		HoldingQueue:   DefaultHoldingQueue,
+		PollTimeout:    time.Second,
+		MaxWait:        5 * time.Second,
+		ExtendInterval: 10 * time.Second,
+		MaxBackoff:     time.Second,
+	}
+}
+
+// PushAt pushes body to queue at t.
+func (s *Scheduler) PushAt(queue string, t time.Time, bodyType string, body io.Reader) (*PushResponse, error) {
+	if bodyType == "" {
+		bodyType = "application/octet-stream"
+	}
+	ct, err := withParams(bodyType, map[string]string{
+		DeliverAtParam: strconv.FormatInt(t.UnixNano(), 10),
+		TargetParam:    queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.Client.Push(s.HoldingQueue, ct, body)
+}
+
+// PushAfter pushes body to queue after d.
+func (s *Scheduler) PushAfter(queue string, d time.Duration, bodyType string, body io.Reader) (*PushResponse, error) {
+	return s.PushAt(queue, time.Now().Add(d), bodyType, body)
+}
+
+// Run delivers due messages until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	seen := make(map[[sha256.Size]byte]bool)
+	var next time.Time
+	for ctx.Err() == nil {
+		m, err := s.Client.Pull(s.HoldingQueue, s.PollTimeout)
+		if err != nil {
+			if !isEmpty(err) {
+				return err
+			}
+			continue
+		}
+		target, ct, at, ok := parseDelayed(m.ContentType)
+		if !ok {
+			// Not pushed by Scheduler, so there is no way to deliver it.
+			s.Client.Reply(m, ReplyAck)
+			continue
+		}
+		wait := time.Until(at)
+		if wait > s.MaxWait {
+			key := parkedKey(m)
+			if seen[key] {
+				s.postpone(m)
+				sleepContext(ctx, minDuration(time.Until(next), s.MaxBackoff))
+				seen, next = make(map[[sha256.Size]byte]bool), time.Time{}
+				continue
+			}
+			seen[key] = true
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			s.postpone(m)
+			continue
+		}
+		if !s.hold(ctx, m, at) {
+			s.Client.Reply(m, ReplyNack)
+			continue
+		}
+		if _, err := s.Client.Push(target, ct, bytes.NewReader(m.Body)); err != nil {
+			s.Client.Reply(m, ReplyNack)
+			sleepContext(ctx, s.MaxBackoff)
+			continue
+		}
+		s.Client.Reply(m, ReplyAck)
+		seen, next = make(map[[sha256.Size]byte]bool), time.Time{}
+	}
+	return ctx.Err()
+}
+
+// parkedKey identifies a parked message across deliveries by its content
+// type, which holds the target and delivery time, and its body. Message IDs
+// cannot be used since LMQ may assign a new one on every delivery. Identical
+// parked messages make Run back off a pass early, costing at most MaxBackoff.
+func parkedKey(m *Message) [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, m.ContentType)
+	h.Write([]byte{0})
+	h.Write(m.Body)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// postpone returns m to the holding queue. Nacking consumes a retry, so the
+// last try is spent on pushing a copy instead.
+func (s *Scheduler) postpone(m *Message) {
+	if m.Retry == 0 {
+		if _, err := s.Client.Push(s.HoldingQueue, m.ContentType, bytes.NewReader(m.Body)); err == nil {
+			s.Client.Reply(m, ReplyAck)
+			return
+		}
+	}
+	s.Client.Reply(m, ReplyNack)
+}
+
+// hold waits until at while extending the timeout of m. It returns false if
+// ctx is done first.
+func (s *Scheduler) hold(ctx context.Context, m *Message, at time.Time) bool {
+	for {
+		wait := time.Until(at)
+		if wait <= 0 {
+			return true
+		}
+		if !sleepContext(ctx, minDuration(wait, s.ExtendInterval)) {
+			return false
+		}
+		if time.Until(at) > 0 {
+			s.Client.Reply(m, ReplyExt)
+		}
+	}
+}
+
+// parseDelayed extracts the target queue, the original content type and the
+// delivery time from the content type of a parked message.
+func parseDelayed(ct string) (string, string, time.Time, bool) {
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	target := params[TargetParam]
+	n, err := strconv.ParseInt(params[DeliverAtParam], 10, 64)
+	if target == "" || err != nil {
+		return "", "", time.Time{}, false
+	}
+	delete(params, TargetParam)
+	delete(params, DeliverAtParam)
+	return target, mime.FormatMediaType(mt, params), time.Unix(0, n), true
+}
+
+// sleepContext sleeps for d and reports whether it was not interrupted by ctx.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
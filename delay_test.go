@@ -0,0 +1,126 @@
+package lmq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	queue := "TestScheduler"
+	c := New(lmqURL)
+	s := NewScheduler(c)
+	s.HoldingQueue = "TestScheduler:holding"
+	s.MaxWait = 50 * time.Millisecond
+	s.MaxBackoff = 20 * time.Millisecond
+	defer c.Delete(queue)
+	defer c.Delete(s.HoldingQueue)
+
+	start := time.Now()
+	_, err := s.PushAfter(queue, 300*time.Millisecond, "text/plain; charset=utf-8", strings.NewReader("later"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.PushAt(queue, start, "text/plain", strings.NewReader("now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	m, err := c.Pull(queue, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "now", string(m.Body))
+	assert.Equal(t, "text/plain", m.ContentType)
+	c.Reply(m, ReplyAck)
+
+	m, err = c.Pull(queue, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "later", string(m.Body))
+	assert.Equal(t, "text/plain; charset=utf-8", m.ContentType)
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	c.Reply(m, ReplyAck)
+}
+
+func TestSchedulerSameDeliveryTime(t *testing.T) {
+	queue := "TestSchedulerSameDeliveryTime"
+	c := New(lmqURL)
+	s := NewScheduler(c)
+	s.HoldingQueue = "TestSchedulerSameDeliveryTime:holding"
+	s.MaxWait = 50 * time.Millisecond
+	s.MaxBackoff = 500 * time.Millisecond
+	defer c.Delete(queue)
+	defer c.Delete(s.HoldingQueue)
+
+	// Parked messages with the same delivery time must not be taken for a
+	// cycle, which would delay the message due soon by MaxBackoff per pair.
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < 6; i++ {
+		_, err := s.PushAt(queue, later, "text/plain", strings.NewReader(fmt.Sprint("later ", i)))
+		must(t, err)
+	}
+	start := time.Now()
+	_, err := s.PushAfter(queue, 100*time.Millisecond, "text/plain", strings.NewReader("soon"))
+	must(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	m, err := c.Pull(queue, 2*time.Second)
+	must(t, err)
+	assert.Equal(t, "soon", string(m.Body))
+	assert.True(t, time.Since(start) < time.Second)
+	c.Reply(m, ReplyAck)
+}
+
+type pullCounter struct {
+	Client
+	pulls int32
+}
+
+func (c *pullCounter) Pull(queue string, timeout time.Duration) (*Message, error) {
+	atomic.AddInt32(&c.pulls, 1)
+	return c.Client.Pull(queue, timeout)
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	c := &pullCounter{Client: New(lmqURL)}
+	s := NewScheduler(c)
+	s.HoldingQueue = "TestSchedulerBackoff:holding"
+	s.MaxBackoff = 100 * time.Millisecond
+	defer c.Delete(s.HoldingQueue)
+	for i := 0; i < 3; i++ {
+		_, err := s.PushAfter("TestSchedulerBackoff", time.Hour, "text/plain", strings.NewReader(fmt.Sprint(i)))
+		must(t, err)
+	}
+
+	// Every pass over the parked messages is followed by MaxBackoff, even
+	// though their IDs change on redelivery.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+	assert.True(t, atomic.LoadInt32(&c.pulls) <= 25, "pulls: %d", c.pulls)
+}
+
+func TestParseDelayed(t *testing.T) {
+	target, ct, at, ok := parseDelayed("application/json; deliver-at=1000000000; target=q")
+	assert.True(t, ok)
+	assert.Equal(t, "q", target)
+	assert.Equal(t, "application/json", ct)
+	assert.Equal(t, time.Unix(1, 0), at)
+
+	_, _, _, ok = parseDelayed("application/json; target=q")
+	assert.False(t, ok)
+}
@@ -0,0 +1,58 @@
+package envelope
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/yosisa/go-lmq"
+)
+
+type client struct {
+	lmq.Client
+	codec *Codec
+}
+
+// Wrap returns a client which seals every pushed body with codec. Only the
+// push methods of lmq.Client and lmq.MetaPusher are sealed; the client
+// implements no other optional interface, so that no other push path can
+// bypass the codec.
+func Wrap(c lmq.Client, codec *Codec) lmq.Client {
+	return &client{Client: c, codec: codec}
+}
+
+func (c *client) Push(queue, bodyType string, body io.Reader) (*lmq.PushResponse, error) {
+	r, err := c.seal(bodyType, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.Client.Push(queue, ContentType, r)
+}
+
+func (c *client) PushAll(queue, bodyType string, body io.Reader) (map[string]*lmq.PushResponse, error) {
+	r, err := c.seal(bodyType, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.Client.PushAll(queue, ContentType, r)
+}
+
+// PushWithMeta seals the body only; meta is sent in the clear.
+func (c *client) PushWithMeta(queue, bodyType string, meta map[string]string, body io.Reader) (*lmq.PushResponse, error) {
+	r, err := c.seal(bodyType, body)
+	if err != nil {
+		return nil, err
+	}
+	return lmq.PushWithMeta(c.Client, queue, ContentType, meta, r)
+}
+
+func (c *client) seal(bodyType string, body io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = c.codec.Seal(bodyType, b); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
@@ -0,0 +1,269 @@
+// Package envelope encrypts and optionally signs message bodies end-to-end.
+//
+// A sealed body is a JSON envelope of ContentType which records the ID of the
+// encryption key and the original content type. Producers push through the
+// client returned by Wrap and consumers register the codec to the registry of
+// their client, so that Message.Decode verifies and decrypts bodies before
+// dispatching them to the decoder of the original content type.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/yosisa/go-lmq"
+)
+
+const ContentType = "application/x-lmq-envelope"
+
+var (
+	ErrUnknownKey = errors.New("envelope: unknown key")
+	ErrSignature  = errors.New("envelope: signature mismatch")
+	ErrUnsigned   = errors.New("envelope: message is not signed")
+	ErrMalformed  = errors.New("envelope: malformed envelope")
+)
+
+// Error is returned when an envelope is rejected. Op is one of "parse",
+// "verify" and "decrypt".
+type Error struct {
+	Op    string
+	KeyID string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("envelope: %s failed (key %q): %v", e.Op, e.KeyID, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KeyProvider looks up secret keys by ID. Encryption keys must be 16, 24 or 32
+// bytes long to select AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a map.
+type StaticKeys map[string][]byte
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	if b, ok := k[id]; ok {
+		return b, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+type Signer interface {
+	Algorithm() string
+	KeyID() string
+	Sign([]byte) ([]byte, error)
+}
+
+type Verifier interface {
+	Verify(alg, keyID string, b, sig []byte) error
+}
+
+// Codec seals and opens envelopes. Keys and KeyID are required to seal, Keys
+// is required to open. If Verifier is set, unsigned envelopes are rejected.
+type Codec struct {
+	Keys     KeyProvider
+	KeyID    string
+	Signer   Signer
+	Verifier Verifier
+}
+
+type envelope struct {
+	KeyID       string     `json:"kid"`
+	ContentType string     `json:"ct"`
+	Nonce       []byte     `json:"nonce"`
+	Data        []byte     `json:"data"`
+	Signature   *signature `json:"sig,omitempty"`
+}
+
+type signature struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Value     []byte `json:"value"`
+}
+
+// Seal encrypts body of contentType and returns the envelope.
+func (c *Codec) Seal(contentType string, body []byte) ([]byte, error) {
+	aead, err := c.aead(c.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	e := &envelope{KeyID: c.KeyID, ContentType: contentType}
+	e.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Data = aead.Seal(nil, e.Nonce, body, e.additionalData())
+	if c.Signer != nil {
+		e.Signature = &signature{Algorithm: c.Signer.Algorithm(), KeyID: c.Signer.KeyID()}
+		if e.Signature.Value, err = c.Signer.Sign(e.signedData()); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(e)
+}
+
+// Open verifies and decrypts an envelope and returns the original content type
+// and body. Rejected envelopes are reported as *Error.
+func (c *Codec) Open(b []byte) (string, []byte, error) {
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return "", nil, &Error{Op: "parse", Err: err}
+	}
+	if e.KeyID == "" || e.ContentType == "" {
+		return "", nil, &Error{Op: "parse", Err: ErrMalformed}
+	}
+	if c.Verifier != nil {
+		if e.Signature == nil {
+			return "", nil, &Error{Op: "verify", KeyID: e.KeyID, Err: ErrUnsigned}
+		}
+		s := e.Signature
+		if err := c.Verifier.Verify(s.Algorithm, s.KeyID, e.signedData(), s.Value); err != nil {
+			return "", nil, &Error{Op: "verify", KeyID: s.KeyID, Err: err}
+		}
+	}
+	aead, err := c.aead(e.KeyID)
+	if err != nil {
+		return "", nil, &Error{Op: "decrypt", KeyID: e.KeyID, Err: err}
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return "", nil, &Error{Op: "decrypt", KeyID: e.KeyID, Err: ErrMalformed}
+	}
+	body, err := aead.Open(nil, e.Nonce, e.Data, e.additionalData())
+	if err != nil {
+		return "", nil, &Error{Op: "decrypt", KeyID: e.KeyID, Err: err}
+	}
+	return e.ContentType, body, nil
+}
+
+// Register registers c as the decoder of ContentType in r. Opened bodies are
+// decoded by the decoder registered in r for the original content type.
+func (c *Codec) Register(r *lmq.Registry) {
+	r.RegisterDecoder(ContentType, lmq.DecoderFunc(func(b []byte, v interface{}) error {
+		ct, body, err := c.Open(b)
+		if err != nil {
+			return err
+		}
+		return r.Decode(ct, body, v)
+	}))
+}
+
+func (c *Codec) aead(keyID string) (cipher.AEAD, error) {
+	key, err := c.Keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the metadata to the ciphertext so that it cannot be
+// swapped without failing authentication.
+func (e *envelope) additionalData() []byte {
+	return appendFields(nil, e.KeyID, e.ContentType)
+}
+
+func (e *envelope) signedData() []byte {
+	b := appendFields([]byte("lmq-envelope-v1"), e.KeyID, e.ContentType)
+	return appendFields(b, string(e.Nonce), string(e.Data))
+}
+
+func appendFields(b []byte, fields ...string) []byte {
+	for _, f := range fields {
+		b = binary.AppendUvarint(b, uint64(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+type hmacSigner struct {
+	id  string
+	key []byte
+}
+
+// HMACSigner signs envelopes with HMAC-SHA256 under key.
+func HMACSigner(keyID string, key []byte) Signer {
+	return &hmacSigner{id: keyID, key: key}
+}
+
+func (s *hmacSigner) Algorithm() string { return "hmac-sha256" }
+func (s *hmacSigner) KeyID() string     { return s.id }
+
+func (s *hmacSigner) Sign(b []byte) ([]byte, error) {
+	return hmacSum(s.key, b), nil
+}
+
+type ed25519Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// Ed25519Signer signs envelopes with an Ed25519 private key.
+func Ed25519Signer(keyID string, key ed25519.PrivateKey) Signer {
+	return &ed25519Signer{id: keyID, key: key}
+}
+
+func (s *ed25519Signer) Algorithm() string { return "ed25519" }
+func (s *ed25519Signer) KeyID() string     { return s.id }
+
+func (s *ed25519Signer) Sign(b []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, b), nil
+}
+
+// KeyVerifier verifies HMAC signatures with keys from HMACKeys and Ed25519
+// signatures with public keys from Ed25519Keys. Either may be nil to reject
+// the algorithm.
+type KeyVerifier struct {
+	HMACKeys    KeyProvider
+	Ed25519Keys map[string]ed25519.PublicKey
+}
+
+func (v *KeyVerifier) Verify(alg, keyID string, b, sig []byte) error {
+	switch alg {
+	case "hmac-sha256":
+		if v.HMACKeys == nil {
+			break
+		}
+		key, err := v.HMACKeys.Key(keyID)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(hmacSum(key, b), sig) {
+			return ErrSignature
+		}
+		return nil
+	case "ed25519":
+		key, ok := v.Ed25519Keys[keyID]
+		if !ok {
+			return ErrUnknownKey
+		}
+		if !ed25519.Verify(key, b, sig) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("envelope: unsupported signature algorithm %q", alg)
+}
+
+func hmacSum(key, b []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(nil)
+}
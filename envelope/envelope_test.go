@@ -0,0 +1,127 @@
+package envelope
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/go-lmq"
+	"github.com/yosisa/go-lmq/lmqtest"
+)
+
+var keys = StaticKeys{
+	"k1": []byte("0123456789abcdef0123456789abcdef"),
+	"s1": []byte("signing secret"),
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := lmqtest.NewServer()
+	defer s.Close()
+	queue := "TestRoundTrip"
+
+	codec := &Codec{
+		Keys:     keys,
+		KeyID:    "k1",
+		Signer:   HMACSigner("s1", keys["s1"]),
+		Verifier: &KeyVerifier{HMACKeys: keys},
+	}
+	reg := lmq.DefaultRegistry.Clone()
+	codec.Register(reg)
+	c := lmq.New(s.URL, lmq.WithRegistry(reg))
+	p := Wrap(c, codec)
+
+	_, err := lmq.PushValue(p, reg, queue, "application/json", map[string]int{"ID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ContentType, m.ContentType)
+	assert.False(t, strings.Contains(string(m.Body), `"ID"`))
+	var v struct{ ID int }
+	assert.Nil(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+
+	_, err = lmq.PushWithMeta(p, queue, "text/plain", map[string]string{"k": "v"}, strings.NewReader("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ContentType, m.ContentType)
+	assert.Equal(t, "v", m.GetMeta("k"))
+	assert.False(t, strings.Contains(string(m.Body), "secret"))
+}
+
+func TestTampered(t *testing.T) {
+	codec := &Codec{Keys: keys, KeyID: "k1", Signer: HMACSigner("s1", keys["s1"])}
+	b, err := codec.Seal("text/plain", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, body, err := codec.Open(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", ct)
+	assert.Equal(t, "secret", string(body))
+
+	tampered := strings.Replace(string(b), `"ct":"text/plain"`, `"ct":"text/html"`, 1)
+	_, _, err = codec.Open([]byte(tampered))
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "decrypt", e.Op)
+
+	codec.Verifier = &KeyVerifier{HMACKeys: keys}
+	_, _, err = codec.Open([]byte(tampered))
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "verify", e.Op)
+	assert.Equal(t, ErrSignature, e.Err)
+
+	unsigned, err := (&Codec{Keys: keys, KeyID: "k1"}).Seal("text/plain", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = codec.Open(unsigned)
+	assert.True(t, errors.Is(err, ErrUnsigned))
+}
+
+func TestEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := &Codec{
+		Keys:     keys,
+		KeyID:    "k1",
+		Signer:   Ed25519Signer("e1", priv),
+		Verifier: &KeyVerifier{Ed25519Keys: map[string]ed25519.PublicKey{"e1": pub}},
+	}
+	b, err := codec.Seal("text/plain", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err := codec.Open(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(body))
+
+	codec.Verifier = &KeyVerifier{HMACKeys: keys}
+	_, _, err = codec.Open(b)
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+}
+
+func TestUnknownKey(t *testing.T) {
+	b, err := (&Codec{Keys: keys, KeyID: "k1"}).Seal("text/plain", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = (&Codec{Keys: StaticKeys{}}).Open(b)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "k1", e.KeyID)
+	assert.Equal(t, ErrUnknownKey, e.Err)
+}
@@ -0,0 +1,170 @@
+package lmq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type SchedulingPolicy int
+
+const (
+	// WeightedRoundRobin pulls from queues in proportion to their weights,
+	// interleaving them smoothly.
+	WeightedRoundRobin SchedulingPolicy = iota
+	// StrictPriority always pulls from the non-empty queue with the highest
+	// weight.
+	StrictPriority
+)
+
+// WeightedQueue is a queue consumed by FairConsumer. Weight is the share for
+// WeightedRoundRobin and the priority for StrictPriority.
+type WeightedQueue struct {
+	Name   string
+	Weight int
+}
+
+// QueueStats is the throughput achieved for a queue.
+type QueueStats struct {
+	Messages   int64
+	EmptyPolls int64
+	// Errors is the number of pulls which failed otherwise.
+	Errors int64
+	// Rate is the number of messages per second since Run started.
+	Rate float64
+}
+
+// FairConsumer consumes a set of queues by pulling them individually, so that
+// a hot queue cannot starve the others as with PullAny. A queue found empty,
+// or failing to be pulled, is skipped for MinBackoff, doubled on each
+// consecutive empty poll or failure up to MaxBackoff.
+type FairConsumer struct {
+	Client     Client
+	Queues     []WeightedQueue
+	Policy     SchedulingPolicy
+	Handler    Handler
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	states  []*queueState
+	current []int
+}
+
+type queueState struct {
+	stats   QueueStats
+	backoff time.Duration
+	until   time.Time
+}
+
+func NewFairConsumer(c Client, queues []WeightedQueue, policy SchedulingPolicy, h Handler) *FairConsumer {
+	return &FairConsumer{
+		Client:     c,
+		Queues:     queues,
+		Policy:     policy,
+		Handler:    h,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+}
+
+// Run handles messages until ctx is done.
+func (c *FairConsumer) Run(ctx context.Context) error {
+	c.mu.Lock()
+	c.start = time.Now()
+	c.states = make([]*queueState, len(c.Queues))
+	for i := range c.states {
+		c.states[i] = new(queueState)
+	}
+	c.current = make([]int, len(c.Queues))
+	c.mu.Unlock()
+
+	for ctx.Err() == nil {
+		i, wait := c.next(time.Now())
+		if i < 0 {
+			sleepContext(ctx, wait)
+			continue
+		}
+		m, err := c.Client.Pull(c.Queues[i].Name, 0)
+		c.record(i, err)
+		if err != nil {
+			continue
+		}
+		c.Handler.HandleMessage(ctx, m)
+	}
+	return ctx.Err()
+}
+
+// next picks the queue to pull. If all queues are backing off, it returns -1
+// and the time until the earliest one becomes ready.
+func (c *FairConsumer) next(now time.Time) (int, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	best, total := -1, 0
+	var wait time.Duration
+	for i, q := range c.Queues {
+		s := c.states[i]
+		if s.until.After(now) {
+			if d := s.until.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		switch c.Policy {
+		case StrictPriority:
+			if best < 0 || q.Weight > c.Queues[best].Weight {
+				best = i
+			}
+		default:
+			// Smooth weighted round robin as in nginx.
+			c.current[i] += q.Weight
+			total += q.Weight
+			if best < 0 || c.current[i] > c.current[best] {
+				best = i
+			}
+		}
+	}
+	if best >= 0 && c.Policy != StrictPriority {
+		c.current[best] -= total
+	}
+	return best, wait
+}
+
+func (c *FairConsumer) record(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.states[i]
+	if err == nil {
+		s.stats.Messages++
+		s.backoff = 0
+		return
+	}
+	if isEmpty(err) {
+		s.stats.EmptyPolls++
+	} else {
+		s.stats.Errors++
+	}
+	if s.backoff == 0 {
+		s.backoff = c.MinBackoff
+	} else if s.backoff *= 2; s.backoff > c.MaxBackoff {
+		s.backoff = c.MaxBackoff
+	}
+	s.until = time.Now().Add(s.backoff)
+}
+
+// Stats returns the statistics of each queue by name.
+func (c *FairConsumer) Stats() map[string]QueueStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make(map[string]QueueStats, len(c.states))
+	elapsed := time.Since(c.start).Seconds()
+	for i, s := range c.states {
+		st := s.stats
+		if elapsed > 0 {
+			st.Rate = float64(st.Messages) / elapsed
+		}
+		stats[c.Queues[i].Name] = st
+	}
+	return stats
+}
@@ -0,0 +1,130 @@
+package lmq
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFairConsumer(policy SchedulingPolicy, weights ...int) *FairConsumer {
+	var queues []WeightedQueue
+	for i, w := range weights {
+		queues = append(queues, WeightedQueue{Name: string(rune('a' + i)), Weight: w})
+	}
+	c := NewFairConsumer(nil, queues, policy, nil)
+	c.states = make([]*queueState, len(queues))
+	for i := range c.states {
+		c.states[i] = new(queueState)
+	}
+	c.current = make([]int, len(queues))
+	return c
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	c := newTestFairConsumer(WeightedRoundRobin, 5, 1, 1)
+	now := time.Now()
+	var order []string
+	for i := 0; i < 7; i++ {
+		n, _ := c.next(now)
+		order = append(order, c.Queues[n].Name)
+	}
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, order)
+}
+
+func TestStrictPriorityBackoff(t *testing.T) {
+	c := newTestFairConsumer(StrictPriority, 1, 3, 2)
+	now := time.Now()
+	n, _ := c.next(now)
+	assert.Equal(t, "b", c.Queues[n].Name)
+
+	c.record(1, &Error{Code: 204})
+	n, _ = c.next(time.Now())
+	assert.Equal(t, "c", c.Queues[n].Name)
+	c.record(2, &Error{Code: 204})
+	c.record(0, &Error{Code: 204})
+	n, wait := c.next(time.Now())
+	assert.Equal(t, -1, n)
+	assert.True(t, wait > 0 && wait <= c.MinBackoff)
+
+	c.record(1, &Error{Code: 204})
+	assert.Equal(t, 2*c.MinBackoff, c.states[1].backoff)
+	c.record(1, nil)
+	assert.Equal(t, time.Duration(0), c.states[1].backoff)
+	assert.Equal(t, int64(1), c.states[1].stats.Messages)
+	assert.Equal(t, int64(2), c.states[1].stats.EmptyPolls)
+}
+
+func TestFairConsumer(t *testing.T) {
+	c := New(lmqURL)
+	defer c.Delete("TestFair:hot")
+	defer c.Delete("TestFair:cold")
+	for i := 0; i < 10; i++ {
+		c.Push("TestFair:hot", "text/plain", strings.NewReader("hot"))
+	}
+	for i := 0; i < 2; i++ {
+		c.Push("TestFair:cold", "text/plain", strings.NewReader("cold"))
+	}
+
+	got := make(chan string, 12)
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- string(m.Body)
+		return nil
+	}), Replier(c))
+	fc := NewFairConsumer(c, []WeightedQueue{{"TestFair:hot", 1}, {"TestFair:cold", 1}}, WeightedRoundRobin, h)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fc.Run(ctx)
+
+	var first []string
+	for i := 0; i < 4; i++ {
+		select {
+		case s := <-got:
+			first = append(first, s)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	assert.Equal(t, []string{"hot", "cold", "hot", "cold"}, first)
+	for i := 0; i < 8; i++ {
+		<-got
+	}
+	stats := fc.Stats()
+	assert.Equal(t, int64(10), stats["TestFair:hot"].Messages)
+	assert.Equal(t, int64(2), stats["TestFair:cold"].Messages)
+	assert.True(t, stats["TestFair:hot"].Rate > 0)
+}
+
+func TestFairConsumerErrors(t *testing.T) {
+	queue := "TestFairConsumerErrors"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+
+	got := make(chan string, 1)
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- string(m.Body)
+		return nil
+	}), Replier(c))
+	// A failing queue backs off without stopping the consumer.
+	fc := NewFairConsumer(c, []WeightedQueue{{"", 2}, {queue, 1}}, WeightedRoundRobin, h)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fc.Run(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	_, err := c.Push(queue, "text/plain", strings.NewReader("ok"))
+	must(t, err)
+	select {
+	case s := <-got:
+		assert.Equal(t, "ok", s)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+	}
+	assert.True(t, fc.Stats()[""].Errors > 0)
+	assert.Equal(t, int64(0), fc.Stats()[""].EmptyPolls)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
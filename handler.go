@@ -0,0 +1,190 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// ErrExtend is returned by a handler to extend the timeout of a message
+// instead of acking or nacking it. It may be wrapped.
+var ErrExtend = errors.New("lmq: extend message timeout")
+
+// Handler processes a message. A nil error means the message has been
+// processed successfully.
+type Handler interface {
+	HandleMessage(context.Context, *Message) error
+}
+
+type HandlerFunc func(context.Context, *Message) error
+
+func (f HandlerFunc) HandleMessage(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// Middleware wraps a handler to add behaviour around it.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mws. The first middleware is the outermost one.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// PanicError is returned by the Recover middleware when a handler panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("lmq: handler panic: %v", e.Value)
+}
+
+// Recover turns panics in handlers into *PanicError.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					buf := make([]byte, 64<<10)
+					buf = buf[:runtime.Stack(buf, false)]
+					err = &PanicError{Value: v, Stack: buf}
+				}
+			}()
+			return next.HandleMessage(ctx, m)
+		})
+	}
+}
+
+// Deadline limits the time to handle a message to d. When d elapses, the
+// context of the handler is cancelled and context.DeadlineExceeded is returned
+// without waiting for the handler to return, so that the message can be
+// replied to before its timeout. Since the handler runs in its own goroutine,
+// its panics are recovered there and returned as *PanicError.
+func Deadline(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			done := make(chan error, 1)
+			h := Recover()(next)
+			go func() {
+				done <- h.HandleMessage(ctx, m)
+			}()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+}
+
+// ReplyFor maps the result of a handler to a reply: nil is ack, ErrExtend is
+// ext and any other error is nack.
+func ReplyFor(err error) ReplyType {
+	switch {
+	case err == nil:
+		return ReplyAck
+	case errors.Is(err, ErrExtend):
+		return ReplyExt
+	}
+	return ReplyNack
+}
+
+// Replier replies to messages by c according to ReplyFor, unless the handler
+// has acked or nacked the message itself. The error of the handler is passed
+// through; a failed reply is returned only if the handler succeeded.
+func Replier(c Client) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) error {
+			err := next.HandleMessage(ctx, m)
+			if m.Replied() {
+				return err
+			}
+			if rerr := c.Reply(m, ReplyFor(err)); err == nil {
+				return rerr
+			}
+			return err
+		})
+	}
+}
+
+// Dedup skips messages which have been handled successfully before. It must
+// be placed inside Replier, which acks the skipped messages.
+func Dedup(s DedupStore, key func(*Message) string) Middleware {
+	if key == nil {
+		key = DedupKey
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) error {
+			k := key(m)
+			dup, err := s.Contains(k)
+			if err != nil {
+				return err
+			}
+			if dup {
+				return nil
+			}
+			if err := next.HandleMessage(ctx, m); err != nil {
+				return err
+			}
+			return s.Add(k)
+		})
+	}
+}
+
+// Consumer pulls messages from Queue and passes them to Handler. If Any is
+// true, Queue is a regular expression given to PullAny. The handler is
+// responsible for replying, usually by the Replier middleware. If Limiter is
+// set, the consumer waits for the limit of Queue before pulling.
+type Consumer struct {
+	Client      Client
+	Queue       string
+	Any         bool
+	Handler     Handler
+	PollTimeout time.Duration
+	Limiter     *RateLimiter
+}
+
+func NewConsumer(c Client, queue string, h Handler) *Consumer {
+	return &Consumer{Client: c, Queue: queue, Handler: h, PollTimeout: time.Second}
+}
+
+// Run handles messages one by one until ctx is done. Errors returned by the
+// handler do not stop the consumer.
+func (c *Consumer) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		release := func() {}
+		if c.Limiter != nil {
+			var err error
+			if release, err = c.Limiter.Acquire(ctx, c.Queue); err != nil {
+				break
+			}
+		}
+		m, err := c.pull()
+		if err != nil {
+			release()
+			if !isEmpty(err) {
+				return err
+			}
+			continue
+		}
+		c.Handler.HandleMessage(ctx, m)
+		release()
+	}
+	return ctx.Err()
+}
+
+func (c *Consumer) pull() (*Message, error) {
+	if c.Any {
+		return c.Client.PullAny(c.Queue, c.PollTimeout)
+	}
+	return c.Client.Pull(c.Queue, c.PollTimeout)
+}
@@ -0,0 +1,114 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, m *Message) error {
+				calls = append(calls, name)
+				return next.HandleMessage(ctx, m)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}), mw("a"), mw("b"))
+	assert.Nil(t, h.HandleMessage(context.Background(), &Message{}))
+	assert.Equal(t, []string{"a", "b", "handler"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		panic("boom")
+	}), Recover())
+	err := h.HandleMessage(context.Background(), &Message{})
+	var pe *PanicError
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, "boom", pe.Value)
+	assert.True(t, len(pe.Stack) > 0)
+}
+
+func TestDeadline(t *testing.T) {
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		time.Sleep(time.Second)
+		return nil
+	}), Deadline(10*time.Millisecond))
+	assert.Equal(t, context.DeadlineExceeded, h.HandleMessage(context.Background(), &Message{}))
+}
+
+func TestDeadlineRecover(t *testing.T) {
+	panicking := HandlerFunc(func(ctx context.Context, m *Message) error {
+		panic("boom")
+	})
+	for _, h := range []Handler{
+		Chain(panicking, Recover(), Deadline(time.Second)),
+		Chain(panicking, Deadline(time.Second), Recover()),
+	} {
+		err := h.HandleMessage(context.Background(), &Message{})
+		if assert.IsType(t, &PanicError{}, err) {
+			assert.Equal(t, "boom", err.(*PanicError).Value)
+		}
+	}
+}
+
+func TestReplyFor(t *testing.T) {
+	assert.Equal(t, ReplyAck, ReplyFor(nil))
+	assert.Equal(t, ReplyExt, ReplyFor(fmt.Errorf("busy: %w", ErrExtend)))
+	assert.Equal(t, ReplyNack, ReplyFor(errors.New("failed")))
+}
+
+func TestConsumer(t *testing.T) {
+	queue := "TestConsumer"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	for _, body := range []string{"ok", "panic", "dup"} {
+		ct := "text/plain"
+		if body != "panic" {
+			ct = "text/plain; idempotency-key=k"
+		}
+		if _, err := c.Push(queue, ct, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handled := make(chan string, 10)
+	panicked := false
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		handled <- string(m.Body)
+		if string(m.Body) == "panic" && !panicked {
+			panicked = true
+			panic("boom")
+		}
+		return nil
+	}), Replier(c), Recover(), Dedup(NewMemoryDedupStore(10, time.Minute), nil))
+	go NewConsumer(c, queue, h).Run(ctx)
+
+	// "panic" is nacked once and redelivered, "dup" is skipped.
+	for _, want := range []string{"ok", "panic", "panic"} {
+		select {
+		case got := <-handled:
+			assert.Equal(t, want, got)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for " + want)
+		}
+	}
+	select {
+	case got := <-handled:
+		t.Fatal("unexpected message: " + got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,14 +1,17 @@
 package lmq
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -56,30 +59,55 @@ type PushResponse struct {
 type client struct {
 	url string
 	c   *http.Client
-	pc  map[time.Duration]*http.Client
-	pcm sync.Mutex
+	reg *Registry
+
+	encoding string
+
+	limiter    *RateLimiter
+	limitBlock bool
+	breaker    *CircuitBreaker
+	auth       Authenticator
 }
 
-func New(url string) Client {
-	return &client{
-		url: strings.TrimRight(url, "/"),
-		c:   newHTTPClient(0),
-		pc:  make(map[time.Duration]*http.Client),
+// Option configures a client created by New.
+type Option func(*client)
+
+// WithRegistry makes the client and messages pulled by it use r instead of
+// DefaultRegistry.
+func WithRegistry(r *Registry) Option {
+	return func(c *client) {
+		c.reg = r
 	}
 }
 
-func newHTTPClient(timeout time.Duration) *http.Client {
-	c := &http.Client{}
-	if timeout >= 0 {
-		c.Timeout = timeout + DefaultTimeout
+// New returns a client of LMQ at url. Besides http and https URLs, url may
+// be unix:///path/to.sock to talk to LMQ over a Unix socket.
+func New(url string, opts ...Option) Client {
+	c := &client{
+		url: strings.TrimRight(url, "/"),
+		c:   &http.Client{Transport: DefaultTransport},
+		reg: DefaultRegistry,
+	}
+	if path, ok := unixSocketPath(url); ok {
+		c.url = unixBaseURL
+		c.c = &http.Client{Transport: NewUnixTransport(path, TransportOptions{})}
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 	return c
 }
 
 func (c *client) Push(queue, bodyType string, body io.Reader) (*PushResponse, error) {
+	u, err := messagesURL(queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.limit(queue); err != nil {
+		return nil, err
+	}
 	var r PushResponse
-	url := "/messages/" + queue
-	err := c.push(url, bodyType, body, &r)
+	err = c.push(u, bodyType, nil, body, &r)
 	return &r, err
 }
 
@@ -87,14 +115,51 @@ func (c *client) PushAll(queue string, bodyType string, body io.Reader) (map[str
 	if _, err := regexp.Compile(queue); err != nil {
 		return nil, err
 	}
+	if err := c.limit(queue); err != nil {
+		return nil, err
+	}
 	var r map[string]*PushResponse
-	url := "/messages?qre=" + queue
-	err := c.push(url, bodyType, body, &r)
+	err := c.push(buildURL(url.Values{"qre": {queue}}, "messages"), bodyType, nil, body, &r)
 	return r, err
 }
 
-func (c *client) push(url, bodyType string, body io.Reader, r interface{}) error {
-	resp, err := c.do("POST", url, bodyType, body)
+// PushValue encodes v as contentType by reg and pushes it to queue by c. A nil
+// reg means the registry of c if c was created by New, or DefaultRegistry.
+func PushValue(c Client, reg *Registry, queue, contentType string, v interface{}) (*PushResponse, error) {
+	b, ct, err := registryOf(c, reg).Encode(contentType, v)
+	if err != nil {
+		return nil, err
+	}
+	return c.Push(queue, ct, bytes.NewReader(b))
+}
+
+// PushAllValue is like PushValue but pushes to all queues matching queue.
+func PushAllValue(c Client, reg *Registry, queue, contentType string, v interface{}) (map[string]*PushResponse, error) {
+	b, ct, err := registryOf(c, reg).Encode(contentType, v)
+	if err != nil {
+		return nil, err
+	}
+	return c.PushAll(queue, ct, bytes.NewReader(b))
+}
+
+func registryOf(c Client, reg *Registry) *Registry {
+	if reg != nil {
+		return reg
+	}
+	if c, ok := c.(*client); ok && c.reg != nil {
+		return c.reg
+	}
+	return DefaultRegistry
+}
+
+func (c *client) push(url, bodyType string, header http.Header, body io.Reader, r interface{}) error {
+	if c.encoding != "" {
+		var err error
+		if bodyType, body, err = compressBody(c.encoding, bodyType, body); err != nil {
+			return err
+		}
+	}
+	resp, err := c.send(DefaultTimeout, "POST", url, bodyType, header, body)
 	if err != nil {
 		return err
 	}
@@ -106,25 +171,29 @@ func (c *client) push(url, bodyType string, body io.Reader, r interface{}) error
 }
 
 func (c *client) Pull(queue string, timeout time.Duration) (*Message, error) {
-	url := fmt.Sprintf("/messages/%s?cf=msgpack", queue)
-	return c.pull(url, timeout)
+	if err := ValidateQueueName(queue); err != nil {
+		return nil, err
+	}
+	return c.pull(url.Values{}, timeout, "messages", queue)
 }
 
 func (c *client) PullAny(queue string, timeout time.Duration) (*Message, error) {
 	if _, err := regexp.Compile(queue); err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("/messages?qre=%s&cf=msgpack", queue)
-	return c.pull(url, timeout)
+	return c.pull(url.Values{"qre": {queue}}, timeout, "messages")
 }
 
-func (c *client) pull(url string, timeout time.Duration) (*Message, error) {
-	if timeout < 0 {
-		timeout = -1
-	} else {
-		url += fmt.Sprintf("&t=%d", int(timeout.Seconds()))
+func (c *client) pull(query url.Values, timeout time.Duration, segments ...string) (*Message, error) {
+	query.Set("cf", "msgpack")
+	// The deadline covers the long poll on top of DefaultTimeout. A negative
+	// timeout waits forever.
+	deadline := time.Duration(-1)
+	if timeout >= 0 {
+		query.Set("t", strconv.Itoa(int(timeout.Seconds())))
+		deadline = timeout + DefaultTimeout
 	}
-	resp, err := do(c.pullClient(timeout), "GET", c.url+url, "", nil)
+	resp, err := c.send(deadline, "GET", buildURL(query, segments...), "", nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -132,23 +201,31 @@ func (c *client) pull(url string, timeout time.Duration) (*Message, error) {
 	if err := checkStatus(resp, http.StatusOK); err != nil {
 		return nil, err
 	}
-	return newMessage(resp)
+	m, err := newMessage(resp)
+	if err != nil {
+		return nil, err
+	}
+	m.reg, m.client = c.reg, c
+	return m, nil
 }
 
-func (c *client) pullClient(timeout time.Duration) *http.Client {
-	c.pcm.Lock()
-	defer c.pcm.Unlock()
-	client, ok := c.pc[timeout]
-	if !ok {
-		client = newHTTPClient(timeout)
-		c.pc[timeout] = client
+// Reply replies r to m. It fails with ErrReplied if m has already been acked
+// or nacked.
+func (c *client) Reply(m *Message, r ReplyType) error {
+	if err := m.beginReply(r); err != nil {
+		return err
 	}
-	return client
+	err := c.reply(m, r)
+	m.endReply(r, err)
+	return err
 }
 
-func (c *client) Reply(m *Message, r ReplyType) error {
-	url := fmt.Sprintf("/messages/%s/%s?reply=%v", m.Queue, m.ID, r)
-	resp, err := c.do("POST", url, "", nil)
+func (c *client) reply(m *Message, r ReplyType) error {
+	u, err := replyURL(m.Queue, m.ID, r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", u, "", nil)
 	if err != nil {
 		return err
 	}
@@ -157,7 +234,11 @@ func (c *client) Reply(m *Message, r ReplyType) error {
 }
 
 func (c *client) Delete(queue string) error {
-	return c.delete("/queues/" + queue)
+	u, err := queueURL("queues", queue)
+	if err != nil {
+		return err
+	}
+	return c.delete(u)
 }
 
 func (c *client) delete(url string) error {
@@ -170,34 +251,91 @@ func (c *client) delete(url string) error {
 }
 
 func (c *client) do(method, url, bodyType string, body io.Reader) (*http.Response, error) {
-	return do(c.c, method, c.url+url, bodyType, body)
+	return c.send(DefaultTimeout, method, url, bodyType, nil, body)
 }
 
-func do(c *http.Client, method, url, bodyType string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, body)
+// send sends a request to url relative to the endpoint through the circuit
+// breaker, if any. The request including reading the response body must
+// complete within timeout unless it is negative.
+func (c *client) send(timeout time.Duration, method, url, bodyType string, header http.Header, body io.Reader) (*http.Response, error) {
+	if c.breaker == nil {
+		return c.authDo(timeout, method, url, bodyType, header, body)
+	}
+	if err := c.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.authDo(timeout, method, url, bodyType, header, body)
+	c.breaker.Record(resp, err)
+	return resp, err
+}
+
+// authDo sends the request authenticated by c.auth. If the server answers
+// 401 and the credentials can be refreshed, they are refreshed and the
+// request is retried once.
+func (c *client) authDo(timeout time.Duration, method, url, bodyType string, header http.Header, body io.Reader) (*http.Response, error) {
+	if c.auth == nil {
+		return do(c.c, nil, timeout, method, c.url+url, bodyType, header, body)
+	}
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := do(c.c, c.auth, timeout, method, c.url+url, bodyType, header, bytes.NewReader(b))
+	r, ok := c.auth.(Refresher)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !ok {
+		return resp, err
+	}
+	if err := r.Refresh(); err != nil {
+		return resp, nil
+	}
+	discard(resp.Body)
+	return do(c.c, c.auth, timeout, method, c.url+url, bodyType, header, bytes.NewReader(b))
+}
+
+func do(c *http.Client, auth Authenticator, timeout time.Duration, method, url, bodyType string, header http.Header, body io.Reader) (*http.Response, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout >= 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	if bodyType != "" {
 		req.Header.Set("Content-Type", bodyType)
 	}
-	escapeQueueName(req)
-	return c.Do(req)
-}
-
-func escapeQueueName(r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	n := len(parts)
-	switch {
-	case strings.Contains(r.URL.RawQuery, "reply="):
-		if n >= 5 {
-			name := strings.Join(parts[2:n-1], "%2F")
-			r.URL.Opaque = fmt.Sprintf("//%s/%s/%s/%s", r.URL.Host, parts[1], name, parts[n-1])
+	if auth != nil {
+		if err := auth.Authenticate(req); err != nil {
+			cancel()
+			return nil, err
 		}
-	case n >= 4:
-		name := strings.Join(parts[2:], "%2F")
-		r.URL.Opaque = fmt.Sprintf("//%s/%s/%s", r.URL.Host, parts[1], name)
 	}
+	resp, err := c.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody releases the deadline of a request when its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 func checkStatus(resp *http.Response, expected int) error {
@@ -1,7 +1,9 @@
 package lmq
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -13,18 +15,59 @@ import (
 
 var lmqURL string
 
-func TestEscapeQueueName(t *testing.T) {
-	r, _ := http.NewRequest("GET", "http://localhost:9980/messages/q", nil)
-	escapeQueueName(r)
-	assert.Equal(t, "http://localhost:9980/messages/q", r.URL.String())
+func TestBuildURL(t *testing.T) {
+	assert.Equal(t, "/messages/q", buildURL(nil, "messages", "q"))
+	assert.Equal(t, "/messages/q%2F1", buildURL(nil, "messages", "q/1"))
+	assert.Equal(t, "/messages/q%2F1/id?reply=ack", buildURL(url.Values{"reply": {"ack"}}, "messages", "q/1", "id"))
+	assert.Equal(t, "/messages/a%3Fb%23c%25d%20e%C3%A9", buildURL(nil, "messages", "a?b#c%d eé"))
+	assert.Equal(t, "/messages?qre=a%2B%26b", buildURL(url.Values{"qre": {"a+&b"}}, "messages"))
 
-	r, _ = http.NewRequest("GET", "http://localhost:9980/messages/q/1", nil)
-	escapeQueueName(r)
-	assert.Equal(t, "http://localhost:9980/messages/q%2F1", r.URL.String())
+	r, _ := http.NewRequest("GET", "http://localhost:9980"+buildURL(nil, "messages", "q/1?"), nil)
+	assert.Equal(t, "/messages/q%2F1%3F", r.URL.RequestURI())
+}
+
+func TestValidateQueueName(t *testing.T) {
+	for _, name := range []string{"q", "a/b", "a?b#c%d e", "キュー", strings.Repeat("x", MaxQueueNameLen)} {
+		assert.Nil(t, ValidateQueueName(name), name)
+	}
+	for _, name := range []string{"", ".", "..", " q", "q\n", "a\x00b", "\xff", strings.Repeat("x", MaxQueueNameLen+1)} {
+		assert.True(t, errors.Is(ValidateQueueName(name), ErrInvalidName), name)
+	}
+
+	c := New(lmqURL)
+	_, err := c.Push("..", "text/plain", strings.NewReader("x"))
+	assert.True(t, errors.Is(err, ErrInvalidName))
+	_, err = c.GetProperty("")
+	assert.True(t, errors.Is(err, ErrInvalidName))
+	assert.True(t, errors.Is(c.Reply(&Message{Queue: "q", ID: "a\nb"}, ReplyAck), ErrInvalidName))
+}
+
+// FuzzQueueName checks that any valid queue name survives the round trip
+// through URLs and the decoding fake server.
+func FuzzQueueName(f *testing.F) {
+	for _, name := range []string{"q", "a/b", "a/b/", "a?b", "a#b", "100%", "a b", "é", "a%2Fb", "a+b", "a;b=c", "./a", "../a"} {
+		f.Add(name)
+	}
+	c := New(lmqURL)
+	f.Fuzz(func(t *testing.T, name string) {
+		if ValidateQueueName(name) != nil {
+			return
+		}
+		defer c.Delete(name)
+		_, err := c.Push(name, "text/plain", strings.NewReader(name))
+		must(t, err)
+		m, err := c.Pull(name, 0)
+		must(t, err)
+		assert.Equal(t, name, m.Queue)
+		assert.Equal(t, name, string(m.Body))
+		must(t, m.Ack())
 
-	r, _ = http.NewRequest("GET", "http://localhost:9980/messages/q/1/id?reply=ack", nil)
-	escapeQueueName(r)
-	assert.Equal(t, "http://localhost:9980/messages/q%2F1/id?reply=ack", r.URL.String())
+		must(t, c.UpdateProperty(name, &Property{Retry: 5}))
+		p, err := c.GetProperty(name)
+		must(t, err)
+		assert.Equal(t, 5, p.Retry)
+		must(t, c.DeleteProperty(name))
+	})
 }
 
 func TestSimple(t *testing.T) {
@@ -54,6 +97,53 @@ func TestSimple(t *testing.T) {
 	assert.True(t, err.(*Error).IsEmpty())
 }
 
+func TestWithRegistry(t *testing.T) {
+	queue := "TestWithRegistry"
+	r := DefaultRegistry.Clone()
+	r.RegisterDecoder("text/plain", DecoderFunc(func(b []byte, v interface{}) error {
+		*v.(*string) = strings.ToUpper(string(b))
+		return nil
+	}))
+	c := New(lmqURL, WithRegistry(r))
+	defer c.Delete(queue)
+
+	_, err := c.Push(queue, "text/plain", strings.NewReader("Hello LMQ"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	assert.Nil(t, m.Decode(&s))
+	assert.Equal(t, "HELLO LMQ", s)
+	assert.Nil(t, c.Reply(m, ReplyAck))
+}
+
+func TestPushValue(t *testing.T) {
+	queue := "TestPushValue"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+
+	_, err := PushValue(c, nil, queue, "application/cbor", map[string]int{"ID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "application/cbor", m.ContentType)
+	var v struct{ ID int }
+	assert.Nil(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+	assert.Nil(t, c.Reply(m, ReplyAck))
+
+	_, err = PushValue(c, nil, queue, "image/png", nil)
+	assert.Equal(t, ErrNoEncoder, err)
+}
+
 func TestDelete(t *testing.T) {
 	queue := "TestDelete"
 	c := New(lmqURL)
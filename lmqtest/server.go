@@ -6,15 +6,22 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 )
 
 type message struct {
-	ct string
-	b  []byte
+	ct       string
+	b        []byte
+	retry    int
+	meta     http.Header
+	enqueued time.Time
 }
 
 type property struct {
@@ -28,6 +35,7 @@ func newProperty() *property {
 }
 
 type FakeLMQ struct {
+	mu       sync.Mutex
 	queues   map[string]chan *message
 	pendings map[string]*message
 	props    map[string]*property
@@ -35,11 +43,17 @@ type FakeLMQ struct {
 }
 
 func NewServer() *httptest.Server {
-	return httptest.NewServer(&FakeLMQ{
+	return httptest.NewServer(NewFakeLMQ())
+}
+
+// NewFakeLMQ returns the handler of the fake server, e.g. to serve it on a
+// listener of its own.
+func NewFakeLMQ() *FakeLMQ {
+	return &FakeLMQ{
 		queues:   make(map[string]chan *message),
 		pendings: make(map[string]*message),
 		props:    make(map[string]*property),
-	})
+	}
 }
 
 func (s *FakeLMQ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -57,32 +71,102 @@ func (s *FakeLMQ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *FakeLMQ) handleSingleMessage(w http.ResponseWriter, r *http.Request) {
-	queue := r.URL.Path[10:]
-	c, ok := s.queues[queue]
+func (s *FakeLMQ) queue(name string) chan *message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.queues[name]
 	if !ok {
 		c = make(chan *message, 100)
-		s.queues[queue] = c
+		s.queues[name] = c
 	}
+	return c
+}
+
+// pathSegments splits the escaped path so that escaped slashes in queue names
+// are kept.
+func pathSegments(r *http.Request) []string {
+	parts := strings.Split(r.URL.EscapedPath(), "/")[1:]
+	for i, p := range parts {
+		if s, err := url.PathUnescape(p); err == nil {
+			parts[i] = s
+		}
+	}
+	return parts
+}
+
+func pullTimeout(r *http.Request) time.Duration {
+	n, _ := strconv.Atoi(r.URL.Query().Get("t"))
+	return time.Duration(n) * time.Second
+}
+
+func (s *FakeLMQ) handleSingleMessage(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r)
+	if reply := r.URL.Query().Get("reply"); reply != "" && len(parts) == 3 {
+		s.reply(w, parts[1], parts[2], reply)
+		return
+	}
+	queue := strings.Join(parts[1:], "/")
+	c := s.queue(queue)
 	switch r.Method {
 	case "GET":
 		select {
 		case m := <-c:
 			s.writeMessage(w, r, m, queue)
+			return
 		default:
+		}
+		timer := time.NewTimer(pullTimeout(r))
+		defer timer.Stop()
+		select {
+		case m := <-c:
+			s.writeMessage(w, r, m, queue)
+		case <-timer.C:
 			w.WriteHeader(http.StatusNoContent)
 		}
 	case "POST":
-		switch r.URL.Query().Get("reply") {
-		case "ack":
-			delete(s.pendings, queue)
-			w.WriteHeader(http.StatusNoContent)
-		case "":
-			b, _ := ioutil.ReadAll(r.Body)
-			c <- &message{ct: r.Header.Get("Content-Type"), b: b}
-			w.Write([]byte(`{"accum":"no"}`))
+		b, _ := ioutil.ReadAll(r.Body)
+		c <- s.newMessage(queue, r, b)
+		w.Write([]byte(`{"accum":"no"}`))
+	}
+}
+
+func (s *FakeLMQ) newMessage(queue string, r *http.Request, b []byte) *message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retry := newProperty().Retry
+	if p := s.props[queue]; p != nil {
+		retry = p.Retry
+	}
+	meta := make(http.Header)
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Lmq-Meta-") {
+			meta[k] = v
 		}
 	}
+	return &message{ct: r.Header.Get("Content-Type"), b: b, retry: retry, meta: meta, enqueued: time.Now()}
+}
+
+func (s *FakeLMQ) reply(w http.ResponseWriter, queue, id, reply string) {
+	s.mu.Lock()
+	key := queue + "/" + id
+	m, ok := s.pendings[key]
+	if ok && reply != "ext" {
+		delete(s.pendings, key)
+	}
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch reply {
+	case "nack":
+		s.queue(queue) <- m
+	case "ack", "ext":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *FakeLMQ) handleMultiMessage(w http.ResponseWriter, r *http.Request) {
@@ -93,8 +177,9 @@ func (s *FakeLMQ) handleMultiMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case "GET":
-		for name, c := range s.queues {
-			if re.MatchString(name) {
+		deadline := time.Now().Add(pullTimeout(r))
+		for {
+			for name, c := range s.matchQueues(re) {
 				select {
 				case m := <-c:
 					s.writeMessage(w, r, m, name)
@@ -102,34 +187,57 @@ func (s *FakeLMQ) handleMultiMessage(w http.ResponseWriter, r *http.Request) {
 				default:
 				}
 			}
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
 		}
 		w.WriteHeader(http.StatusNoContent)
 	case "POST":
 		var resp []string
 		b, _ := ioutil.ReadAll(r.Body)
-		for name, c := range s.queues {
-			if re.MatchString(name) {
-				c <- &message{ct: r.Header.Get("Content-Type"), b: b}
-				resp = append(resp, fmt.Sprintf(`"%s":{"accum":"no"}`, name))
-			}
+		for name, c := range s.matchQueues(re) {
+			c <- s.newMessage(name, r, b)
+			resp = append(resp, fmt.Sprintf(`"%s":{"accum":"no"}`, name))
 		}
 		fmt.Fprintf(w, `{%s}`, strings.Join(resp, ","))
 	}
 }
 
+func (s *FakeLMQ) matchQueues(re *regexp.Regexp) map[string]chan *message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queues := make(map[string]chan *message)
+	for name, c := range s.queues {
+		if re.MatchString(name) {
+			queues[name] = c
+		}
+	}
+	return queues
+}
+
 func (s *FakeLMQ) writeMessage(w http.ResponseWriter, r *http.Request, m *message, queue string) {
 	id := uuid.NewRandom().String()
+	s.mu.Lock()
 	s.pendings[queue+"/"+id] = m
+	s.mu.Unlock()
 	w.Header().Set("X-Lmq-Message-Id", id)
 	w.Header().Set("X-Lmq-Queue-Name", queue)
 	w.Header().Set("X-Lmq-Message-Type", "normal")
-	w.Header().Set("X-Lmq-Retry-Remaining", "2")
+	w.Header().Set("X-Lmq-Retry-Remaining", strconv.Itoa(m.retry))
 	w.Header().Set("Content-Type", m.ct)
+	w.Header().Set("X-Lmq-Enqueued-At", m.enqueued.Format(time.RFC3339Nano))
+	w.Header().Set("X-Lmq-Delivered-At", time.Now().Format(time.RFC3339Nano))
+	for k, v := range m.meta {
+		w.Header()[k] = v
+	}
 	w.Write(m.b)
 }
 
 func (s *FakeLMQ) handleQueue(w http.ResponseWriter, r *http.Request) {
-	queue := r.URL.Path[8:]
+	queue := strings.Join(pathSegments(r)[1:], "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	switch r.Method {
 	case "DELETE":
 		if _, ok := s.queues[queue]; !ok {
@@ -142,7 +250,9 @@ func (s *FakeLMQ) handleQueue(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *FakeLMQ) handleQueueProperty(w http.ResponseWriter, r *http.Request) {
-	queue := r.URL.Path[12:]
+	queue := strings.Join(pathSegments(r)[1:], "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	switch r.Method {
 	case "GET":
 		p, _ := s.props[queue]
@@ -165,6 +275,8 @@ func (s *FakeLMQ) handleQueueProperty(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *FakeLMQ) handleDefaultQueueProperty(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	switch r.Method {
 	case "GET":
 		if s.defProps == nil {
@@ -0,0 +1,143 @@
+package lmq
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const messageBinaryVersion = 1
+
+var errMessageFormat = errors.New("lmq: invalid message encoding")
+
+// messageWire is the marshaled form of Message. Pos is the number of parts
+// already decoded, so that a compound message continues from where it was
+// left.
+type messageWire struct {
+	ID          string            `json:"id" codec:"id"`
+	Queue       string            `json:"queue" codec:"queue"`
+	MessageType string            `json:"type" codec:"type"`
+	Retry       int               `json:"retry" codec:"retry"`
+	ContentType string            `json:"content_type" codec:"content_type"`
+	Body        []byte            `json:"body" codec:"body"`
+	Header      http.Header       `json:"header,omitempty" codec:"header,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty" codec:"meta,omitempty"`
+	EnqueuedAt  int64             `json:"enqueued_at,omitempty" codec:"enqueued_at,omitempty"`
+	DeliveredAt int64             `json:"delivered_at,omitempty" codec:"delivered_at,omitempty"`
+	Pos         int               `json:"pos,omitempty" codec:"pos,omitempty"`
+}
+
+// MarshalBinary encodes m including how far it has been decoded, so that it
+// can be handed over to another process which decodes it and replies by its
+// own client, see Bind. The registry, client and reply state of m are not
+// encoded; an unmarshaled message uses DefaultRegistry.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, mh).Encode(m.wire()); err != nil {
+		return nil, err
+	}
+	return append([]byte{messageBinaryVersion}, b...), nil
+}
+
+func (m *Message) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 || b[0] != messageBinaryVersion {
+		return errMessageFormat
+	}
+	var w messageWire
+	if err := codec.NewDecoderBytes(b[1:], mh).Decode(&w); err != nil {
+		return err
+	}
+	return m.fromWire(&w)
+}
+
+// MarshalJSON is the JSON form of MarshalBinary.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.wire())
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var w messageWire
+	if err := json.Unmarshal(b, &w); err != nil {
+		return err
+	}
+	return m.fromWire(&w)
+}
+
+func (m *Message) wire() *messageWire {
+	return &messageWire{
+		ID:          m.ID,
+		Queue:       m.Queue,
+		MessageType: m.MessageType,
+		Retry:       m.Retry,
+		ContentType: m.ContentType,
+		Body:        m.Body,
+		Header:      m.Header,
+		Meta:        m.Meta,
+		EnqueuedAt:  unixNano(m.EnqueuedAt),
+		DeliveredAt: unixNano(m.DeliveredAt),
+		Pos:         m.pos,
+	}
+}
+
+func (m *Message) fromWire(w *messageWire) error {
+	*m = Message{
+		Metadata: Metadata{
+			Meta:        w.Meta,
+			EnqueuedAt:  fromUnixNano(w.EnqueuedAt),
+			DeliveredAt: fromUnixNano(w.DeliveredAt),
+		},
+		ID:          w.ID,
+		Queue:       w.Queue,
+		MessageType: w.MessageType,
+		Retry:       w.Retry,
+		ContentType: w.ContentType,
+		Body:        w.Body,
+		Header:      w.Header,
+		rs:          new(replyState),
+	}
+	return m.seek(w.Pos)
+}
+
+// seek restores the decoding state after pos parts have been decoded.
+func (m *Message) seek(pos int) error {
+	if pos <= 0 {
+		return nil
+	}
+	switch m.MessageType {
+	case "normal":
+		m.eof, m.pos = EOF, 1
+		return nil
+	case "compound":
+		var cm compoundMessage
+		if err := msgpackDecoder(m.Body, &cm); err != nil {
+			return err
+		}
+		if pos > len(cm) {
+			return errMessageFormat
+		}
+		m.part = m.newPart(cm[pos-1])
+		m.cm, m.pos = cm[pos:], pos
+		if len(m.cm) == 0 {
+			m.eof = EOF
+		}
+		return nil
+	}
+	return errMessageFormat
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,101 @@
+package lmq
+
+import (
+	"encoding"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalMessage(t *testing.T) {
+	queue := "TestMarshalMessage"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	_, err := PushWithMeta(c, queue, "application/json", map[string]string{"k": "v"}, strings.NewReader(`{"ID":1}`))
+	must(t, err)
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+
+	b, err := m.MarshalBinary()
+	must(t, err)
+	var m2 Message
+	must(t, m2.UnmarshalBinary(b))
+	assert.Equal(t, m.ID, m2.ID)
+	assert.Equal(t, m.Queue, m2.Queue)
+	assert.Equal(t, m.Retry, m2.Retry)
+	assert.Equal(t, m.Header, m2.Header)
+	assert.Equal(t, m.Meta, m2.Meta)
+	assert.True(t, m.EnqueuedAt.Equal(m2.EnqueuedAt))
+
+	var v struct{ ID int }
+	must(t, m2.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+	assert.Equal(t, EOF, m2.Decode(&v))
+	must(t, New(lmqURL).Reply(&m2, ReplyAck))
+	assert.NotNil(t, c.Reply(m, ReplyAck))
+
+	assert.Equal(t, errMessageFormat, m2.UnmarshalBinary([]byte{0}))
+}
+
+func TestBindRegistry(t *testing.T) {
+	m := &Message{ID: "id", Queue: "q", MessageType: "normal", ContentType: "application/x-custom", Body: []byte("x")}
+	b, err := m.MarshalBinary()
+	must(t, err)
+	var m2 Message
+	must(t, m2.UnmarshalBinary(b))
+
+	reg := DefaultRegistry.Clone()
+	reg.RegisterDecoder("application/x-custom", DecoderFunc(func(b []byte, v interface{}) error {
+		*v.(*string) = "custom:" + string(b)
+		return nil
+	}))
+	m2.Bind(New(lmqURL, WithRegistry(reg)))
+	var s string
+	must(t, m2.Decode(&s))
+	assert.Equal(t, "custom:x", s)
+}
+
+func TestMarshalCompound(t *testing.T) {
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": "application/json", "trace-id": "a"}, []byte(`{"ID":1}`)},
+		{map[string]interface{}{"content-type": "application/json", "trace-id": "b"}, []byte(`{"ID":2}`)},
+	})
+	must(t, err)
+
+	codecs := []struct {
+		marshal   func(*Message) ([]byte, error)
+		unmarshal func(*Message, []byte) error
+	}{
+		{(*Message).MarshalBinary, (*Message).UnmarshalBinary},
+		{func(m *Message) ([]byte, error) { return json.Marshal(m) }, func(m *Message, b []byte) error { return json.Unmarshal(b, m) }},
+	}
+	for _, cd := range codecs {
+		m := &Message{ID: "id", Queue: "q", MessageType: "compound", Retry: 1, Body: body}
+		var v struct{ ID int }
+		must(t, m.Decode(&v))
+
+		b, err := cd.marshal(m)
+		must(t, err)
+		var m2 Message
+		must(t, cd.unmarshal(&m2, b))
+		assert.Equal(t, "a", m2.Part().GetMeta("trace-id"))
+		must(t, m2.Decode(&v))
+		assert.Equal(t, 2, v.ID)
+		assert.Equal(t, "b", m2.Part().GetMeta("trace-id"))
+		assert.Equal(t, EOF, m2.Decode(&v))
+
+		// A fully decoded message stays at EOF.
+		b, err = cd.marshal(&m2)
+		must(t, err)
+		var m3 Message
+		must(t, cd.unmarshal(&m3, b))
+		assert.Equal(t, EOF, m3.Decode(&v))
+	}
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*Message)(nil)
+	_ encoding.BinaryUnmarshaler = (*Message)(nil)
+)
@@ -3,10 +3,14 @@ package lmq
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/ugorji/go/codec"
 )
@@ -21,27 +25,46 @@ func (f DecoderFunc) Decode(b []byte, v interface{}) error {
 	return f(b, v)
 }
 
+// ParamDecoder is implemented by decoders which want to receive the media type
+// parameters (e.g. charset) of the content being decoded.
+type ParamDecoder interface {
+	Decoder
+	DecodeParams([]byte, map[string]string, interface{}) error
+}
+
 var (
 	EOF       = errors.New("lmq: message reached EOF")
 	ErrDecode = errors.New("lmq: message decode error")
+	ErrEncode = errors.New("lmq: message encode error")
 
-	DefaultDecoder = new(duplicator)
-	decoderMap     = make(map[string]Decoder)
-)
+	ErrUnsupportedCharset = errors.New("lmq: unsupported charset")
 
-func RegisterDecoder(contentType string, d Decoder) {
-	decoderMap[contentType] = d
-}
+	// DefaultDecoder is used by registries which have no default decoder of
+	// their own.
+	//
+	// Deprecated: Assigning to DefaultDecoder is not safe for concurrent use.
+	// Use Registry.SetDefaultDecoder instead.
+	DefaultDecoder Decoder = new(duplicator)
+)
 
+// Message is a message pulled from LMQ. Header holds the response headers
+// which are not mapped to fields.
 type Message struct {
+	Metadata
 	ID          string
 	Queue       string
 	MessageType string
 	Retry       int
 	ContentType string
 	Body        []byte
+	Header      http.Header
+	reg         *Registry
 	cm          compoundMessage
+	part        *Part
+	pos         int
 	eof         error
+	client      Client
+	rs          *replyState
 }
 
 // newMessage creates Message from *http.Response.
@@ -57,12 +80,14 @@ func newMessage(resp *http.Response) (*Message, error) {
 		Retry:       -1,
 		ContentType: resp.Header.Get("Content-Type"),
 		Body:        b,
+		rs:          new(replyState),
 	}
 	if s := resp.Header.Get("X-Lmq-Retry-Remaining"); s != "" {
 		if n, err := strconv.Atoi(s); err == nil {
 			m.Retry = n
 		}
 	}
+	m.parseHeader(resp.Header)
 	return m, nil
 }
 
@@ -73,8 +98,8 @@ func (m *Message) Decode(v interface{}) error {
 
 	switch m.MessageType {
 	case "normal":
-		m.eof = EOF
-		return decodeBody(m.ContentType, m.Body, v)
+		m.eof, m.pos = EOF, 1
+		return m.registry().Decode(m.ContentType, m.Body, v)
 	case "compound":
 		if m.cm == nil {
 			if err := msgpackDecoder(m.Body, &m.cm); err != nil {
@@ -83,27 +108,52 @@ func (m *Message) Decode(v interface{}) error {
 		}
 		var msg []interface{}
 		msg, m.cm = m.cm[0], m.cm[1:]
+		m.pos++
 		if len(m.cm) == 0 {
 			m.eof = EOF
 		}
-		meta, body := msg[0].(map[string]interface{}), msg[1].([]byte)
-		return decodeBody(meta["content-type"].(string), body, v)
+		m.part = m.newPart(msg)
+		return m.part.Decode(v)
 	}
 	return ErrDecode
 }
 
+// registry returns the registry of the client which pulled m, or
+// DefaultRegistry if m was not created by a client.
+func (m *Message) registry() *Registry {
+	if m.reg != nil {
+		return m.reg
+	}
+	return DefaultRegistry
+}
+
+// partContentType returns the content type of a compound part. Other string
+// metadata of the part, such as a schema ID, is merged into the content type
+// as parameters so that decoders can see it.
+func partContentType(meta map[string]interface{}) string {
+	ct, _ := meta["content-type"].(string)
+	if len(meta) == 1 {
+		return ct
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct
+	}
+	for k, v := range meta {
+		if s, ok := v.(string); ok && k != "content-type" {
+			if _, exists := params[k]; !exists {
+				params[k] = s
+			}
+		}
+	}
+	return mime.FormatMediaType(mt, params)
+}
+
 // compoundMessage represents compounded message. Actually, its format is list
 // of length 2 list (metadata, content) where type of metadata is
 // map[string]interface{} and type of content is interface{}.
 type compoundMessage [][]interface{}
 
-func decodeBody(ct string, b []byte, v interface{}) error {
-	if d, ok := decoderMap[ct]; ok {
-		return d.Decode(b, v)
-	}
-	return DefaultDecoder.Decode(b, v)
-}
-
 func msgpackDecoder(b []byte, v interface{}) error {
 	return codec.NewDecoderBytes(b, mh).Decode(v)
 }
@@ -112,16 +162,51 @@ func jsonDecoder(b []byte, v interface{}) error {
 	return json.Unmarshal(b, v)
 }
 
+func msgpackEncoder(v interface{}) ([]byte, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, mh).Encode(v)
+	return b, err
+}
+
+func jsonEncoder(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// rawEncoder passes through byte slices and strings as they are.
+func rawEncoder(v interface{}) ([]byte, error) {
+	switch in := v.(type) {
+	case []byte:
+		return in, nil
+	case string:
+		return []byte(in), nil
+	case fmt.Stringer:
+		return []byte(in.String()), nil
+	}
+	return nil, ErrEncode
+}
+
 type duplicator struct {
 	preferStr bool
 }
 
 func (d *duplicator) Decode(b []byte, v interface{}) error {
+	return d.DecodeParams(b, nil, v)
+}
+
+func (d *duplicator) DecodeParams(b []byte, params map[string]string, v interface{}) error {
+	if d.preferStr {
+		var err error
+		if b, err = toUTF8(b, params["charset"]); err != nil {
+			return err
+		}
+	}
 	switch out := v.(type) {
 	case []byte:
 		copy(out, b)
 	case *[]byte:
 		*out = b
+	case *string:
+		*out = string(b)
 	case *interface{}:
 		if d.preferStr {
 			*out = string(b)
@@ -134,11 +219,37 @@ func (d *duplicator) Decode(b []byte, v interface{}) error {
 	return nil
 }
 
+// toUTF8 transcodes b from charset to UTF-8. Supported are UTF-8, US-ASCII
+// and ISO-8859-1, which can be converted without tables; an empty charset
+// means UTF-8. Other charsets fail with ErrUnsupportedCharset rather than
+// passing b on as if it were UTF-8.
+func toUTF8(b []byte, charset string) ([]byte, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return b, nil
+	case "iso-8859-1", "latin1", "l1":
+		buf := make([]byte, 0, len(b)*2)
+		for _, c := range b {
+			buf = utf8.AppendRune(buf, rune(c))
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedCharset, charset)
+}
+
 var mh = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
 
 func init() {
 	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	RegisterDecoder("application/x-msgpack", DecoderFunc(msgpackDecoder))
 	RegisterDecoder("application/json", DecoderFunc(jsonDecoder))
-	RegisterDecoder("text/plain", &duplicator{preferStr: true})
+	RegisterDecoder("+msgpack", DecoderFunc(msgpackDecoder))
+	RegisterDecoder("+json", DecoderFunc(jsonDecoder))
+	RegisterDecoder("text/*", &duplicator{preferStr: true})
+	RegisterEncoder("application/x-msgpack", EncoderFunc(msgpackEncoder))
+	RegisterEncoder("application/json", EncoderFunc(jsonEncoder))
+	RegisterEncoder("+msgpack", EncoderFunc(msgpackEncoder))
+	RegisterEncoder("+json", EncoderFunc(jsonEncoder))
+	RegisterEncoder("text/*", EncoderFunc(rawEncoder))
+	RegisterEncoder("application/octet-stream", EncoderFunc(rawEncoder))
 }
@@ -1,12 +1,14 @@
 package lmq
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func must(t *testing.T, err error) {
@@ -113,3 +115,186 @@ func TestCompound(t *testing.T) {
 	assert.Equal(t, 2, v.ID)
 	assert.Equal(t, EOF, m.Decode(&v))
 }
+
+func TestDecodeMediaTypeParams(t *testing.T) {
+	m := &Message{
+		MessageType: "normal",
+		ContentType: "application/json; charset=utf-8",
+		Body:        []byte(`{"ID":1}`),
+	}
+	var v struct {
+		ID int
+	}
+	must(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+
+	m = &Message{MessageType: "normal", ContentType: "text/plain; charset=ISO-8859-1", Body: []byte{0x63, 0x61, 0x66, 0xe9}}
+	var s interface{}
+	must(t, m.Decode(&s))
+	assert.Equal(t, "café", s)
+
+	m = &Message{MessageType: "normal", ContentType: "text/plain; charset=shift_jis", Body: []byte{0x82, 0xa0}}
+	assert.True(t, errors.Is(m.Decode(&s), ErrUnsupportedCharset))
+}
+
+func TestDecodeStructuredSuffix(t *testing.T) {
+	m := &Message{
+		MessageType: "normal",
+		ContentType: "application/vnd.myco.order+json",
+		Body:        []byte(`{"ID":1}`),
+	}
+	var v struct {
+		ID int
+	}
+	must(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+
+	m = &Message{
+		MessageType: "normal",
+		ContentType: "application/vnd.myco.order+msgpack",
+		Body:        []byte{0x81, 0xa2, 0x49, 0x44, 0x02},
+	}
+	must(t, m.Decode(&v))
+	assert.Equal(t, 2, v.ID)
+}
+
+func TestDecodeWildcard(t *testing.T) {
+	var params map[string]string
+	r := DefaultRegistry.Clone()
+	r.RegisterDecoder("image/*", DecoderFunc(func(b []byte, v interface{}) error {
+		*v.(*string) = "image"
+		return nil
+	}))
+	r.RegisterDecoder("application/vnd.myco.image", &paramRecorder{&params})
+
+	m := &Message{MessageType: "normal", ContentType: "image/png", Body: []byte("png"), reg: r}
+	var s string
+	must(t, m.Decode(&s))
+	assert.Equal(t, "image", s)
+
+	m = &Message{MessageType: "normal", ContentType: "Application/Vnd.Myco.Image; Profile=x", Body: []byte("x"), reg: r}
+	must(t, m.Decode(&s))
+	assert.Equal(t, map[string]string{"profile": "x"}, params)
+
+	m = &Message{MessageType: "normal", ContentType: "text/html", Body: []byte("<p>"), reg: r}
+	var i interface{}
+	must(t, m.Decode(&i))
+	assert.Equal(t, "<p>", i)
+}
+
+type paramRecorder struct {
+	params *map[string]string
+}
+
+func (p *paramRecorder) Decode(b []byte, v interface{}) error {
+	return nil
+}
+
+func (p *paramRecorder) DecodeParams(b []byte, params map[string]string, v interface{}) error {
+	*p.params = params
+	return nil
+}
+
+func TestRegistryIsolation(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterDecoder("application/json", DecoderFunc(func(b []byte, v interface{}) error {
+		*v.(*string) = "custom"
+		return nil
+	}))
+	r.SetDefaultDecoder(DecoderFunc(func(b []byte, v interface{}) error {
+		*v.(*string) = "default"
+		return nil
+	}))
+
+	var s string
+	m := &Message{MessageType: "normal", ContentType: "application/json", Body: []byte(`"json"`), reg: r}
+	must(t, m.Decode(&s))
+	assert.Equal(t, "custom", s)
+	m = &Message{MessageType: "normal", ContentType: "text/plain", Body: []byte("text"), reg: r}
+	must(t, m.Decode(&s))
+	assert.Equal(t, "default", s)
+
+	m = &Message{MessageType: "normal", ContentType: "application/json", Body: []byte(`"json"`)}
+	must(t, m.Decode(&s))
+	assert.Equal(t, "json", s)
+}
+
+func TestDecodeProtobuf(t *testing.T) {
+	b, ct, err := DefaultRegistry.Encode("application/x-protobuf", wrapperspb.String("hello"))
+	must(t, err)
+	assert.Equal(t, "application/x-protobuf; proto=google.protobuf.StringValue", ct)
+
+	m := &Message{MessageType: "normal", ContentType: ct, Body: b}
+	var v wrapperspb.StringValue
+	must(t, m.Decode(&v))
+	assert.Equal(t, "hello", v.Value)
+
+	m = &Message{MessageType: "normal", ContentType: ct, Body: b}
+	var i interface{}
+	must(t, m.Decode(&i))
+	assert.Equal(t, "hello", i.(*wrapperspb.StringValue).Value)
+
+	m = &Message{MessageType: "normal", ContentType: ct, Body: b}
+	assert.NotNil(t, m.Decode(&wrapperspb.Int64Value{}))
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	b, ct, err := DefaultRegistry.Encode("application/cbor", map[string]int{"ID": 1})
+	must(t, err)
+	assert.Equal(t, "application/cbor", ct)
+
+	m := &Message{MessageType: "normal", ContentType: ct, Body: b}
+	var v struct {
+		ID int
+	}
+	must(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+
+	m = &Message{MessageType: "normal", ContentType: "application/vnd.myco+cbor", Body: b}
+	var i interface{}
+	must(t, m.Decode(&i))
+	assert.Equal(t, map[string]interface{}{"ID": uint64(1)}, i)
+}
+
+func TestCompoundCodecs(t *testing.T) {
+	pb, pct, err := DefaultRegistry.Encode("application/x-protobuf", wrapperspb.String("pb"))
+	must(t, err)
+	cb, cct, err := DefaultRegistry.Encode("application/cbor", "cbor")
+	must(t, err)
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": pct}, pb},
+		{map[string]interface{}{"content-type": cct}, cb},
+	})
+	must(t, err)
+
+	m := &Message{MessageType: "compound", Body: body}
+	var v wrapperspb.StringValue
+	must(t, m.Decode(&v))
+	assert.Equal(t, "pb", v.Value)
+	var s string
+	must(t, m.Decode(&s))
+	assert.Equal(t, "cbor", s)
+	assert.Equal(t, EOF, m.Decode(&s))
+}
+
+func TestEncodeNoEncoder(t *testing.T) {
+	_, _, err := DefaultRegistry.Encode("image/png", []byte{})
+	assert.Equal(t, ErrNoEncoder, err)
+	_, _, err = DefaultRegistry.Encode("application/x-protobuf", "not proto")
+	assert.Equal(t, ErrEncode, err)
+}
+
+func TestCompoundPartMetadataParams(t *testing.T) {
+	var params map[string]string
+	r := DefaultRegistry.Clone()
+	r.RegisterDecoder("application/json", &paramRecorder{&params})
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": "application/json; charset=utf-8", "schema": "order.v1"}, []byte(`{}`)},
+	})
+	must(t, err)
+
+	m := &Message{MessageType: "compound", Body: body, reg: r}
+	var v interface{}
+	must(t, m.Decode(&v))
+	assert.Equal(t, map[string]string{"charset": "utf-8", "schema": "order.v1"}, params)
+}
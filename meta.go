@@ -0,0 +1,216 @@
+package lmq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetaHeaderPrefix is the prefix of the headers carrying producer metadata.
+const MetaHeaderPrefix = "X-Lmq-Meta-"
+
+// Headers and compound part metadata carrying the timestamps of a message.
+const (
+	EnqueuedAtHeader  = "X-Lmq-Enqueued-At"
+	DeliveredAtHeader = "X-Lmq-Delivered-At"
+	EnqueuedAtKey     = "enqueued-at"
+)
+
+// Metadata is the metadata of a message or of a part of a compound message.
+// Keys of Meta are lower case. Timestamps are zero unless the server
+// provides them.
+type Metadata struct {
+	Meta        map[string]string
+	EnqueuedAt  time.Time
+	DeliveredAt time.Time
+}
+
+// GetMeta returns the metadata value of key, which is case insensitive.
+func (md *Metadata) GetMeta(key string) string {
+	return md.Meta[strings.ToLower(key)]
+}
+
+// Part is a part of a message. A normal message has a single part.
+type Part struct {
+	Metadata
+	ContentType string
+	Body        []byte
+	reg         *Registry
+}
+
+// Decode decodes the body of p as its content type.
+func (p *Part) Decode(v interface{}) error {
+	return p.reg.Decode(p.ContentType, p.Body, v)
+}
+
+// Parts returns all parts of m. Unlike Decode, it does not advance m.
+func (m *Message) Parts() ([]*Part, error) {
+	switch m.MessageType {
+	case "normal":
+		return []*Part{m.Part()}, nil
+	case "compound":
+		var cm compoundMessage
+		if err := msgpackDecoder(m.Body, &cm); err != nil {
+			return nil, err
+		}
+		parts := make([]*Part, len(cm))
+		for i, msg := range cm {
+			parts[i] = m.newPart(msg)
+		}
+		return parts, nil
+	}
+	return nil, ErrDecode
+}
+
+// Part returns the part last decoded by Decode, or nil before the first part
+// of a compound message is decoded. A normal message is its own part.
+func (m *Message) Part() *Part {
+	if m.MessageType == "normal" {
+		return &Part{Metadata: m.Metadata, ContentType: m.ContentType, Body: m.Body, reg: m.registry()}
+	}
+	return m.part
+}
+
+// newPart creates a part of a compound message. Parts inherit the delivery
+// time of the message.
+func (m *Message) newPart(msg []interface{}) *Part {
+	meta, body := msg[0].(map[string]interface{}), msg[1].([]byte)
+	p := &Part{ContentType: partContentType(meta), Body: body, reg: m.registry()}
+	p.DeliveredAt = m.DeliveredAt
+	for k, v := range meta {
+		k = strings.ToLower(k)
+		switch {
+		case k == "content-type":
+		case k == EnqueuedAtKey:
+			p.EnqueuedAt = parseTimestamp(fmt.Sprint(v))
+		default:
+			if s, ok := v.(string); ok {
+				if p.Meta == nil {
+					p.Meta = make(map[string]string)
+				}
+				p.Meta[k] = s
+			}
+		}
+	}
+	return p
+}
+
+// lmqHeaders are the headers mapped to the fields of Message.
+var lmqHeaders = []string{
+	"X-Lmq-Message-Id",
+	"X-Lmq-Queue-Name",
+	"X-Lmq-Message-Type",
+	"X-Lmq-Retry-Remaining",
+	"Content-Type",
+	EnqueuedAtHeader,
+	DeliveredAtHeader,
+}
+
+// parseHeader sets the metadata of m from h and keeps the other headers in
+// m.Header. Without DeliveredAtHeader, the Date header is used as the delivery
+// time.
+func (m *Message) parseHeader(h http.Header) {
+	m.Header = h.Clone()
+	for k, v := range h {
+		if strings.HasPrefix(k, MetaHeaderPrefix) && len(v) > 0 {
+			if m.Meta == nil {
+				m.Meta = make(map[string]string)
+			}
+			m.Meta[strings.ToLower(k[len(MetaHeaderPrefix):])] = v[0]
+			delete(m.Header, k)
+		}
+	}
+	m.EnqueuedAt = parseTimestamp(h.Get(EnqueuedAtHeader))
+	if s := h.Get(DeliveredAtHeader); s != "" {
+		m.DeliveredAt = parseTimestamp(s)
+	} else if t, err := http.ParseTime(h.Get("Date")); err == nil {
+		m.DeliveredAt = t
+	}
+	for _, k := range lmqHeaders {
+		delete(m.Header, k)
+	}
+}
+
+// parseTimestamp parses RFC 3339 or (fractional) Unix seconds. It returns the
+// zero time for anything else.
+func parseTimestamp(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9))
+	}
+	return time.Time{}
+}
+
+var ErrMetaUnsupported = errors.New("lmq: client does not support metadata")
+
+// MetaPusher is implemented by clients which can attach producer metadata to
+// pushed messages. Clients created by New implement it.
+type MetaPusher interface {
+	PushWithMeta(queue, bodyType string, meta map[string]string, body io.Reader) (*PushResponse, error)
+}
+
+// PushWithMeta is like Push but attaches meta to the message as headers
+// prefixed by MetaHeaderPrefix. Keys are case insensitive and must consist of
+// letters, digits and hyphens. c must implement MetaPusher, otherwise
+// ErrMetaUnsupported is returned.
+func PushWithMeta(c Client, queue, bodyType string, meta map[string]string, body io.Reader) (*PushResponse, error) {
+	mp, ok := c.(MetaPusher)
+	if !ok {
+		return nil, ErrMetaUnsupported
+	}
+	return mp.PushWithMeta(queue, bodyType, meta, body)
+}
+
+func (c *client) PushWithMeta(queue, bodyType string, meta map[string]string, body io.Reader) (*PushResponse, error) {
+	header, err := metaHeader(meta)
+	if err != nil {
+		return nil, err
+	}
+	u, err := messagesURL(queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.limit(queue); err != nil {
+		return nil, err
+	}
+	var r PushResponse
+	err = c.push(u, bodyType, header, body, &r)
+	return &r, err
+}
+
+func metaHeader(meta map[string]string) (http.Header, error) {
+	h := make(http.Header, len(meta))
+	for k, v := range meta {
+		if !validMetaKey(k) {
+			return nil, fmt.Errorf("lmq: invalid metadata key %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("lmq: invalid metadata value for %q", k)
+		}
+		h.Set(textproto.CanonicalMIMEHeaderKey(MetaHeaderPrefix+k), v)
+	}
+	return h, nil
+}
+
+func validMetaKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package lmq
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushWithMeta(t *testing.T) {
+	queue := "TestPushWithMeta"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+
+	before := time.Now()
+	_, err := PushWithMeta(c, queue, "text/plain", map[string]string{"Trace-Id": "abc", "tenant": "t1"}, strings.NewReader("hello"))
+	must(t, err)
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	assert.Equal(t, map[string]string{"trace-id": "abc", "tenant": "t1"}, m.Meta)
+	assert.Equal(t, "abc", m.GetMeta("TRACE-ID"))
+	assert.False(t, m.EnqueuedAt.Before(before))
+	assert.False(t, m.DeliveredAt.Before(m.EnqueuedAt))
+	assert.NotEmpty(t, m.Header.Get("Date"))
+	assert.Empty(t, m.Header.Get("X-Lmq-Message-Id"))
+	assert.Empty(t, m.Header.Get("X-Lmq-Meta-Tenant"))
+
+	parts, err := m.Parts()
+	must(t, err)
+	assert.Len(t, parts, 1)
+	assert.Equal(t, "t1", parts[0].GetMeta("tenant"))
+	var s interface{}
+	must(t, parts[0].Decode(&s))
+	assert.Equal(t, "hello", s)
+
+	_, err = PushWithMeta(c, queue, "text/plain", map[string]string{"bad key": "x"}, strings.NewReader(""))
+	assert.NotNil(t, err)
+	_, err = PushWithMeta(c, queue, "text/plain", map[string]string{"key": "a\r\nb"}, strings.NewReader(""))
+	assert.NotNil(t, err)
+
+	wrapped := struct{ Client }{c}
+	_, err = PushWithMeta(wrapped, queue, "text/plain", map[string]string{"k": "v"}, strings.NewReader(""))
+	assert.Equal(t, ErrMetaUnsupported, err)
+}
+
+func TestCompoundParts(t *testing.T) {
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": "application/json", "trace-id": "a", "enqueued-at": 1700000000.5}, []byte(`{"ID":1}`)},
+		{map[string]interface{}{"content-type": "application/json", "enqueued-at": "2023-11-14T22:13:21Z"}, []byte(`{"ID":2}`)},
+	})
+	must(t, err)
+	delivered := time.Unix(1700000100, 0)
+	m := &Message{MessageType: "compound", Body: body, Metadata: Metadata{DeliveredAt: delivered}}
+
+	parts, err := m.Parts()
+	must(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "a", parts[0].GetMeta("trace-id"))
+	assert.Equal(t, time.Unix(1700000000, 5e8), parts[0].EnqueuedAt)
+	assert.Equal(t, delivered, parts[0].DeliveredAt)
+	assert.True(t, parts[1].EnqueuedAt.Equal(time.Unix(1700000001, 0)))
+
+	assert.Nil(t, m.Part())
+	var v struct{ ID int }
+	for i := 0; i < 2; i++ {
+		must(t, m.Decode(&v))
+		assert.Equal(t, i+1, v.ID)
+		assert.Equal(t, parts[i].Meta, m.Part().Meta)
+		assert.Equal(t, parts[i].EnqueuedAt, m.Part().EnqueuedAt)
+	}
+}
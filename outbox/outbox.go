@@ -0,0 +1,100 @@
+// Package outbox implements the transactional outbox pattern for producers
+// backed by an SQL database.
+//
+// Messages are written to an outbox table within the caller's transaction, so
+// they are published if and only if the transaction commits. A Relay reads
+// unsent rows afterwards, pushes them to LMQ and marks them as sent, retrying
+// failed rows with exponential backoff. Delivery is at least once: a row is
+// pushed again if marking it as sent fails.
+//
+// The table must have the following columns. Times are stored as Unix time in
+// nanoseconds to stay independent of the time handling of drivers. For
+// example, in SQLite:
+//
+//	CREATE TABLE lmq_outbox (
+//		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+//		queue        TEXT    NOT NULL, -- queue name, or pattern if multi
+//		multi        INTEGER NOT NULL, -- 1 to push with PushAll
+//		content_type TEXT    NOT NULL,
+//		body         BLOB    NOT NULL,
+//		created_at   INTEGER NOT NULL,
+//		attempts     INTEGER NOT NULL DEFAULT 0,
+//		next_attempt INTEGER NOT NULL,
+//		sent_at      INTEGER,          -- NULL until sent
+//		last_error   TEXT
+//	);
+//	CREATE INDEX lmq_outbox_unsent ON lmq_outbox (sent_at, next_attempt);
+//
+// In PostgreSQL, use BIGSERIAL, BIGINT and BYTEA instead and set
+// Outbox.Placeholder to Dollar.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Execer is implemented by *sql.Tx and *sql.DB.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Question formats the n-th (1-origin) placeholder as "?".
+func Question(n int) string {
+	return "?"
+}
+
+// Dollar formats the n-th (1-origin) placeholder as "$n".
+func Dollar(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+type Outbox struct {
+	Table       string
+	Placeholder func(n int) string
+}
+
+// New creates an Outbox writing to table with "?" placeholders.
+func New(table string) *Outbox {
+	return &Outbox{Table: table, Placeholder: Question}
+}
+
+// Push records a message to be pushed to queue.
+func (o *Outbox) Push(ctx context.Context, tx Execer, queue, contentType string, body []byte) error {
+	return o.insert(ctx, tx, queue, false, contentType, body)
+}
+
+// PushAll records a message to be pushed to all queues matching pattern.
+func (o *Outbox) PushAll(ctx context.Context, tx Execer, pattern, contentType string, body []byte) error {
+	return o.insert(ctx, tx, pattern, true, contentType, body)
+}
+
+func (o *Outbox) insert(ctx context.Context, tx Execer, queue string, multi bool, ct string, body []byte) error {
+	now := time.Now().UnixNano()
+	q := fmt.Sprintf("INSERT INTO %s (queue, multi, content_type, body, created_at, attempts, next_attempt) VALUES (%s)",
+		o.Table, o.placeholders(1, 7))
+	_, err := tx.ExecContext(ctx, q, queue, boolInt(multi), ct, body, now, 0, now)
+	return err
+}
+
+func (o *Outbox) placeholders(from, to int) string {
+	var b bytes.Buffer
+	for i := from; i <= to; i++ {
+		if i > from {
+			b.WriteString(", ")
+		}
+		b.WriteString(o.Placeholder(i))
+	}
+	return b.String()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
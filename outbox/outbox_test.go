@@ -0,0 +1,157 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/go-lmq"
+	"github.com/yosisa/go-lmq/lmqtest"
+)
+
+const schema = `CREATE TABLE lmq_outbox (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue        TEXT    NOT NULL,
+	multi        INTEGER NOT NULL,
+	content_type TEXT    NOT NULL,
+	body         BLOB    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL,
+	sent_at      INTEGER,
+	last_error   TEXT
+)`
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRelay(t *testing.T) {
+	s := lmqtest.NewServer()
+	defer s.Close()
+	db := openDB(t)
+	defer db.Close()
+	ctx := context.Background()
+	o := New("lmq_outbox")
+	c := lmq.New(s.URL)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, o.Push(ctx, tx, "TestRelay", "text/plain", []byte("committed")))
+	assert.Nil(t, tx.Commit())
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, o.Push(ctx, tx, "TestRelay", "text/plain", []byte("rolled back")))
+	assert.Nil(t, tx.Rollback())
+
+	r := NewRelay(db, o, c)
+	n, err := r.RelayOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	m, err := c.Pull("TestRelay", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "committed", string(m.Body))
+	_, err = c.Pull("TestRelay", 0)
+	assert.True(t, err.(*lmq.Error).IsEmpty())
+
+	n, err = r.RelayOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRelayDefaults(t *testing.T) {
+	s := lmqtest.NewServer()
+	defer s.Close()
+	db := openDB(t)
+	defer db.Close()
+	o := New("lmq_outbox")
+	c := lmq.New(s.URL)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, o.Push(context.Background(), tx, "TestRelayDefaults", "text/plain", []byte("x")))
+	assert.Nil(t, tx.Commit())
+
+	// A zero Relay runs with the defaults of NewRelay.
+	r := &Relay{DB: db, Outbox: o, Client: c}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, r.Run(ctx))
+	m, err := c.Pull("TestRelayDefaults", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "x", string(m.Body))
+}
+
+func TestRelayRetry(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	ctx := context.Background()
+	o := New("lmq_outbox")
+	assert.Nil(t, o.Push(ctx, db, "TestRelayRetry", "text/plain", []byte("retry")))
+
+	r := NewRelay(db, o, lmq.New("http://127.0.0.1:1"))
+	r.MinBackoff, r.MaxBackoff = time.Hour, time.Hour
+	n, err := r.RelayOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	var attempts int
+	var lastError sql.NullString
+	var next int64
+	err = db.QueryRow("SELECT attempts, last_error, next_attempt FROM lmq_outbox").Scan(&attempts, &lastError, &next)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, lastError.Valid)
+	assert.True(t, time.Unix(0, next).After(time.Now().Add(59*time.Minute)))
+
+	n, err = r.RelayOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	s := lmqtest.NewServer()
+	defer s.Close()
+	_, err = db.Exec("UPDATE lmq_outbox SET next_attempt = 0")
+	assert.Nil(t, err)
+	r.Client = lmq.New(s.URL)
+	n, err = r.RelayOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	err = db.QueryRow("SELECT attempts FROM lmq_outbox WHERE sent_at IS NOT NULL").Scan(&attempts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestBackoff(t *testing.T) {
+	r := &Relay{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, r.backoff(0))
+	assert.Equal(t, 2*time.Second, r.backoff(1))
+	assert.Equal(t, 4*time.Second, r.backoff(2))
+	assert.Equal(t, 5*time.Second, r.backoff(3))
+
+	r = &Relay{}
+	assert.Equal(t, time.Second, r.backoff(0))
+	assert.Equal(t, 5*time.Minute, r.backoff(20))
+}
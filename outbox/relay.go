@@ -0,0 +1,169 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/yosisa/go-lmq"
+)
+
+// Relay publishes the rows of an Outbox. Only one relay should run for a table
+// at a time; concurrent relays would push the same rows. Zero or negative
+// BatchSize, Interval, MinBackoff and MaxBackoff select the defaults used by
+// NewRelay.
+type Relay struct {
+	DB         *sql.DB
+	Outbox     *Outbox
+	Client     lmq.Client
+	BatchSize  int
+	Interval   time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultBatchSize  = 100
+	defaultInterval   = time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+func NewRelay(db *sql.DB, o *Outbox, c lmq.Client) *Relay {
+	return &Relay{
+		DB:         db,
+		Outbox:     o,
+		Client:     c,
+		BatchSize:  defaultBatchSize,
+		Interval:   defaultInterval,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}
+}
+
+type row struct {
+	id       int64
+	queue    string
+	multi    bool
+	ct       string
+	body     []byte
+	attempts int
+}
+
+// Run relays rows every Interval until ctx is done. A full batch is followed
+// by the next batch immediately.
+func (r *Relay) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if n == r.batchSize() {
+			continue
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RelayOnce pushes a batch of due rows in order of insertion and returns the
+// number of rows read. Push failures are recorded on the rows, not returned.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	rows, err := r.due(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if err := r.push(row); err != nil {
+			err = r.markFailed(ctx, row, err)
+		} else {
+			err = r.markSent(ctx, row)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+func (r *Relay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return r.BatchSize
+}
+
+func (r *Relay) due(ctx context.Context) ([]*row, error) {
+	o := r.Outbox
+	q := fmt.Sprintf("SELECT id, queue, multi, content_type, body, attempts FROM %s WHERE sent_at IS NULL AND next_attempt <= %s ORDER BY id LIMIT %d",
+		o.Table, o.Placeholder(1), r.batchSize())
+	rs, err := r.DB.QueryContext(ctx, q, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var rows []*row
+	for rs.Next() {
+		var row row
+		var multi int
+		if err := rs.Scan(&row.id, &row.queue, &multi, &row.ct, &row.body, &row.attempts); err != nil {
+			return nil, err
+		}
+		row.multi = multi != 0
+		rows = append(rows, &row)
+	}
+	return rows, rs.Err()
+}
+
+func (r *Relay) push(row *row) error {
+	if row.multi {
+		_, err := r.Client.PushAll(row.queue, row.ct, bytes.NewReader(row.body))
+		return err
+	}
+	_, err := r.Client.Push(row.queue, row.ct, bytes.NewReader(row.body))
+	return err
+}
+
+func (r *Relay) markSent(ctx context.Context, row *row) error {
+	o := r.Outbox
+	q := fmt.Sprintf("UPDATE %s SET sent_at = %s, attempts = %s WHERE id = %s",
+		o.Table, o.Placeholder(1), o.Placeholder(2), o.Placeholder(3))
+	_, err := r.DB.ExecContext(ctx, q, time.Now().UnixNano(), row.attempts+1, row.id)
+	return err
+}
+
+func (r *Relay) markFailed(ctx context.Context, row *row, cause error) error {
+	o := r.Outbox
+	next := time.Now().Add(r.backoff(row.attempts)).UnixNano()
+	q := fmt.Sprintf("UPDATE %s SET attempts = %s, next_attempt = %s, last_error = %s WHERE id = %s",
+		o.Table, o.Placeholder(1), o.Placeholder(2), o.Placeholder(3), o.Placeholder(4))
+	_, err := r.DB.ExecContext(ctx, q, row.attempts+1, next, cause.Error(), row.id)
+	return err
+}
+
+// backoff doubles MinBackoff for each failed attempt up to MaxBackoff.
+func (r *Relay) backoff(attempts int) time.Duration {
+	d, max := r.MinBackoff, r.MaxBackoff
+	if d <= 0 {
+		d = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	for i := 0; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
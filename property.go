@@ -86,17 +86,29 @@ func (p *DefaultProperty) UnmarshalJSON(b []byte) error {
 }
 
 func (c *client) GetProperty(queue string) (*Property, error) {
+	u, err := queueURL("properties", queue)
+	if err != nil {
+		return nil, err
+	}
 	var p Property
-	err := c.getProperty("/properties/"+queue, &p)
+	err = c.getProperty(u, &p)
 	return &p, err
 }
 
 func (c *client) UpdateProperty(queue string, p *Property) error {
-	return c.setProperty("PATCH", "/properties/"+queue, p)
+	u, err := queueURL("properties", queue)
+	if err != nil {
+		return err
+	}
+	return c.setProperty("PATCH", u, p)
 }
 
 func (c *client) DeleteProperty(queue string) error {
-	return c.delete("/properties/" + queue)
+	u, err := queueURL("properties", queue)
+	if err != nil {
+		return err
+	}
+	return c.delete(u)
 }
 
 func (c *client) GetDefaultProperty() ([]*DefaultProperty, error) {
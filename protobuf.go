@@ -0,0 +1,64 @@
+package lmq
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// protobufCodec decodes and encodes protocol buffers messages. The full name
+// of the message type is carried in the "proto" parameter of the content type,
+// e.g. "application/x-protobuf; proto=example.Order".
+type protobufCodec struct{}
+
+func (c protobufCodec) Decode(b []byte, v interface{}) error {
+	return c.DecodeParams(b, nil, v)
+}
+
+func (protobufCodec) DecodeParams(b []byte, params map[string]string, v interface{}) error {
+	name := protoreflect.FullName(params["proto"])
+	switch out := v.(type) {
+	case proto.Message:
+		if got := out.ProtoReflect().Descriptor().FullName(); name != "" && name != got {
+			return fmt.Errorf("lmq: protobuf message type mismatch: %s != %s", name, got)
+		}
+		return proto.Unmarshal(b, out)
+	case *interface{}:
+		if name == "" {
+			return ErrDecode
+		}
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(name)
+		if err != nil {
+			return err
+		}
+		m := mt.New().Interface()
+		if err := proto.Unmarshal(b, m); err != nil {
+			return err
+		}
+		*out = m
+		return nil
+	}
+	return ErrDecode
+}
+
+func (c protobufCodec) Encode(v interface{}) ([]byte, error) {
+	return c.EncodeParams(v, make(map[string]string))
+}
+
+func (protobufCodec) EncodeParams(v interface{}, params map[string]string) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrEncode
+	}
+	params["proto"] = string(m.ProtoReflect().Descriptor().FullName())
+	return proto.Marshal(m)
+}
+
+func init() {
+	for _, ct := range []string{"application/x-protobuf", "application/protobuf", "+proto"} {
+		RegisterDecoder(ct, protobufCodec{})
+		RegisterEncoder(ct, protobufCodec{})
+	}
+}
@@ -0,0 +1,271 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("lmq: rate limited")
+
+// Limit is the limit applied to a queue. Rate is in messages per second and
+// Burst is the capacity of the token bucket; a Rate of zero means unlimited
+// and a Burst of zero or less means 1.
+// MaxInFlight limits the number of messages handled concurrently by
+// consumers; zero means unlimited.
+type Limit struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+}
+
+func (lim Limit) burst() float64 {
+	if lim.Burst <= 0 {
+		return 1
+	}
+	return float64(lim.Burst)
+}
+
+type limiter struct {
+	mu       sync.Mutex
+	limit    Limit
+	tokens   float64
+	last     time.Time
+	inflight int
+	released chan struct{}
+}
+
+func newLimiter(lim Limit) *limiter {
+	return &limiter{limit: lim, tokens: lim.burst(), last: time.Now(), released: make(chan struct{})}
+}
+
+func (l *limiter) set(lim Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.limit = lim
+	if l.tokens > lim.burst() {
+		l.tokens = lim.burst()
+	}
+	l.broadcast()
+}
+
+func (l *limiter) refill(now time.Time) {
+	if l.limit.Rate > 0 {
+		l.tokens = math.Min(l.limit.burst(), l.tokens+now.Sub(l.last).Seconds()*l.limit.Rate)
+	}
+	l.last = now
+}
+
+// reserve takes a token if available, or returns the time to wait for one.
+func (l *limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.Rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	for {
+		d := l.reserve()
+		if d == 0 {
+			return nil
+		}
+		if !sleepContext(ctx, d) {
+			return ctx.Err()
+		}
+	}
+}
+
+// acquire waits for an in-flight slot.
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.limit.MaxInFlight <= 0 || l.inflight < l.limit.MaxInFlight {
+			l.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		ch := l.released
+		l.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.broadcast()
+}
+
+func (l *limiter) broadcast() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+type patternLimiter struct {
+	re *regexp.Regexp
+	l  *limiter
+}
+
+// RateLimiter applies limits by queue name or by regular expression. A limit
+// for a regular expression is shared by all queues matching it; an exact name
+// takes precedence, then the expressions in order of registration. Limits can
+// be updated at any time.
+type RateLimiter struct {
+	mu       sync.RWMutex
+	exact    map[string]*limiter
+	patterns []*patternLimiter
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{exact: make(map[string]*limiter)}
+}
+
+// SetLimit sets the limit of queue.
+func (r *RateLimiter) SetLimit(queue string, lim Limit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.exact[queue]; ok {
+		l.set(lim)
+	} else {
+		r.exact[queue] = newLimiter(lim)
+	}
+}
+
+// SetLimitRegexp sets the limit shared by the queues matching pattern.
+func (r *RateLimiter) SetLimitRegexp(pattern string, lim Limit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.patterns {
+		if p.re.String() == pattern {
+			p.l.set(lim)
+			return nil
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	r.patterns = append(r.patterns, &patternLimiter{re: re, l: newLimiter(lim)})
+	return nil
+}
+
+// RemoveLimit removes the limit set for queue or pattern.
+func (r *RateLimiter) RemoveLimit(queueOrPattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.exact[queueOrPattern]; ok {
+		l.set(Limit{})
+		delete(r.exact, queueOrPattern)
+	}
+	for i, p := range r.patterns {
+		if p.re.String() == queueOrPattern {
+			p.l.set(Limit{})
+			r.patterns = append(r.patterns[:i], r.patterns[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *RateLimiter) lookup(queue string) *limiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if l, ok := r.exact[queue]; ok {
+		return l
+	}
+	for _, p := range r.patterns {
+		if p.re.MatchString(queue) {
+			return p.l
+		}
+	}
+	return nil
+}
+
+// Allow takes a token for queue if available without waiting.
+func (r *RateLimiter) Allow(queue string) bool {
+	if l := r.lookup(queue); l != nil {
+		return l.reserve() == 0
+	}
+	return true
+}
+
+// Wait waits for a token for queue.
+func (r *RateLimiter) Wait(ctx context.Context, queue string) error {
+	if l := r.lookup(queue); l != nil {
+		return l.wait(ctx)
+	}
+	return nil
+}
+
+// Acquire waits for an in-flight slot and a token for queue. release must be
+// called when the message has been handled.
+func (r *RateLimiter) Acquire(ctx context.Context, queue string) (release func(), err error) {
+	l := r.lookup(queue)
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.wait(ctx); err != nil {
+		l.release()
+		return nil, err
+	}
+	var once sync.Once
+	return func() { once.Do(l.release) }, nil
+}
+
+// WithRateLimit limits pushes by r. The queue name, or the pattern for
+// PushAll, is used to look up the limit. If block is true, pushes wait for a
+// token; otherwise they fail with ErrRateLimited.
+func WithRateLimit(r *RateLimiter, block bool) Option {
+	return func(c *client) {
+		c.limiter = r
+		c.limitBlock = block
+	}
+}
+
+func (c *client) limit(queue string) error {
+	if c.limiter == nil {
+		return nil
+	}
+	if c.limitBlock {
+		return c.limiter.Wait(context.Background(), queue)
+	}
+	if !c.limiter.Allow(queue) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// RateLimit limits the handling of messages by the limits of their queues.
+// Prefer Consumer.Limiter where possible, which waits before pulling so that
+// the timeout of a message does not run while it is waiting.
+func RateLimit(r *RateLimiter) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) error {
+			release, err := r.Acquire(ctx, m.Queue)
+			if err != nil {
+				return err
+			}
+			defer release()
+			return next.HandleMessage(ctx, m)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	r := NewRateLimiter()
+	r.SetLimit("q", Limit{Rate: 1, Burst: 2})
+	must(t, r.SetLimitRegexp("^p:", Limit{Rate: 1, Burst: 1}))
+	assert.True(t, r.Allow("q"))
+	assert.True(t, r.Allow("q"))
+	assert.False(t, r.Allow("q"))
+
+	assert.True(t, r.Allow("p:1"))
+	assert.False(t, r.Allow("p:2"))
+	assert.True(t, r.Allow("other"))
+
+	r.SetLimit("q", Limit{Rate: 1000, Burst: 1})
+	time.Sleep(5 * time.Millisecond)
+	assert.True(t, r.Allow("q"))
+	r.RemoveLimit("^p:")
+	assert.True(t, r.Allow("p:3"))
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	r := NewRateLimiter()
+	r.SetLimit("q", Limit{Rate: 20, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		must(t, r.Wait(context.Background(), "q"))
+	}
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, r.Wait(ctx, "q"))
+}
+
+func TestRateLimiterZeroBurst(t *testing.T) {
+	r := NewRateLimiter()
+	r.SetLimit("q", Limit{Rate: 100})
+	assert.True(t, r.Allow("q"))
+	assert.False(t, r.Allow("q"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	must(t, r.Wait(ctx, "q"))
+}
+
+func TestRateLimiterInFlight(t *testing.T) {
+	r := NewRateLimiter()
+	r.SetLimit("q", Limit{MaxInFlight: 1})
+	release, err := r.Acquire(context.Background(), "q")
+	must(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = r.Acquire(ctx, "q")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	done := make(chan struct{})
+	go func() {
+		release, _ := r.Acquire(context.Background(), "q")
+		release()
+		close(done)
+	}()
+	release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not released")
+	}
+}
+
+func TestPushRateLimit(t *testing.T) {
+	queue := "TestPushRateLimit"
+	r := NewRateLimiter()
+	r.SetLimit(queue, Limit{Rate: 1, Burst: 1})
+	c := New(lmqURL, WithRateLimit(r, false))
+	defer c.Delete(queue)
+
+	_, err := c.Push(queue, "text/plain", strings.NewReader("1"))
+	assert.Nil(t, err)
+	_, err = c.Push(queue, "text/plain", strings.NewReader("2"))
+	assert.Equal(t, ErrRateLimited, err)
+
+	r.SetLimit(queue, Limit{Rate: 50, Burst: 1})
+	c = New(lmqURL, WithRateLimit(r, true))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err = c.Push(queue, "text/plain", strings.NewReader("3"))
+		assert.Nil(t, err)
+	}
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+}
+
+func TestPushRateLimitInvalidName(t *testing.T) {
+	queue := "TestPushRateLimitInvalidName"
+	r := NewRateLimiter()
+	must(t, r.SetLimitRegexp("", Limit{Rate: 0.001, Burst: 1}))
+	c := New(lmqURL, WithRateLimit(r, false))
+	defer c.Delete(queue)
+
+	// Invalid names fail before taking a token.
+	_, err := c.Push("..", "text/plain", strings.NewReader("x"))
+	assert.True(t, errors.Is(err, ErrInvalidName))
+	_, err = PushWithMeta(c, "..", "text/plain", nil, strings.NewReader("x"))
+	assert.True(t, errors.Is(err, ErrInvalidName))
+	_, err = c.Push(queue, "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+}
+
+func TestConsumerRateLimit(t *testing.T) {
+	queue := "TestConsumerRateLimit"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	for i := 0; i < 4; i++ {
+		c.Push(queue, "text/plain", strings.NewReader("x"))
+	}
+	r := NewRateLimiter()
+	r.SetLimit(queue, Limit{Rate: 20, Burst: 1})
+
+	var n int32
+	consumer := NewConsumer(c, queue, Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&n, 1)
+		return nil
+	}), Replier(c)))
+	consumer.Limiter = r
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	consumer.Run(ctx)
+	assert.True(t, atomic.LoadInt32(&n) <= 3)
+}
@@ -0,0 +1,203 @@
+package lmq
+
+import (
+	"errors"
+	"mime"
+	"strings"
+	"sync"
+)
+
+var ErrNoEncoder = errors.New("lmq: no encoder for content type")
+
+type Encoder interface {
+	Encode(interface{}) ([]byte, error)
+}
+
+type EncoderFunc func(interface{}) ([]byte, error)
+
+func (f EncoderFunc) Encode(v interface{}) ([]byte, error) {
+	return f(v)
+}
+
+// ParamEncoder is implemented by encoders which want to read or add media type
+// parameters of the content being encoded. params is pre-populated with the
+// parameters of the requested content type.
+type ParamEncoder interface {
+	Encoder
+	EncodeParams(interface{}, map[string]string) ([]byte, error)
+}
+
+// DefaultRegistry is the registry used by clients created without
+// WithRegistry and by messages which are not pulled by a client.
+var DefaultRegistry = NewRegistry()
+
+// RegisterDecoder registers d for contentType in DefaultRegistry.
+func RegisterDecoder(contentType string, d Decoder) {
+	DefaultRegistry.RegisterDecoder(contentType, d)
+}
+
+// RegisterEncoder registers e for contentType in DefaultRegistry.
+func RegisterEncoder(contentType string, e Encoder) {
+	DefaultRegistry.RegisterEncoder(contentType, e)
+}
+
+// Registry maps content types to decoders and encoders. It is safe for
+// concurrent use, so codecs can be registered while messages are being
+// decoded.
+type Registry struct {
+	mu       sync.RWMutex
+	decoders map[string]Decoder
+	encoders map[string]Encoder
+	def      Decoder
+}
+
+// NewRegistry creates an empty registry. Use DefaultRegistry.Clone to start
+// with the built-in codecs instead.
+func NewRegistry() *Registry {
+	return &Registry{
+		decoders: make(map[string]Decoder),
+		encoders: make(map[string]Encoder),
+	}
+}
+
+// Clone returns a copy of r which can be modified independently.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := NewRegistry()
+	c.def = r.def
+	for k, d := range r.decoders {
+		c.decoders[k] = d
+	}
+	for k, e := range r.encoders {
+		c.encoders[k] = e
+	}
+	return c
+}
+
+// RegisterDecoder registers d for contentType. Parameters in contentType are
+// ignored. Besides a full media type, contentType may be a wildcard such as
+// "text/*" or "*/*", or a structured syntax suffix such as "+json".
+func (r *Registry) RegisterDecoder(contentType string, d Decoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decoders[normalizeMediaType(contentType)] = d
+}
+
+// SetDefaultDecoder sets the decoder used when no registered decoder matches.
+// If it is nil, the package level DefaultDecoder is used.
+func (r *Registry) SetDefaultDecoder(d Decoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.def = d
+}
+
+// Decode decodes b of contentType into v. If b is compressed, it is
+// decompressed before being passed to the decoder.
+func (r *Registry) Decode(contentType string, b []byte, v interface{}) error {
+	contentType, b, err := decompressBody(contentType, b)
+	if err != nil {
+		return err
+	}
+	d, params := r.lookupDecoder(contentType)
+	if pd, ok := d.(ParamDecoder); ok {
+		return pd.DecodeParams(b, params, v)
+	}
+	return d.Decode(b, v)
+}
+
+// Decoder returns the decoder which Decode uses for contentType.
+func (r *Registry) Decoder(contentType string) Decoder {
+	d, _ := r.lookupDecoder(contentType)
+	return d
+}
+
+// lookupDecoder finds the decoder for ct. The candidates are tried in order of
+// the exact media type, its structured syntax suffix (e.g. "+json"), "type/*"
+// and "*/*". The default decoder is used if nothing matches.
+func (r *Registry) lookupDecoder(ct string) (Decoder, map[string]string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mt, params, err := mime.ParseMediaType(ct)
+	if mt == "" {
+		if d, ok := r.decoders[normalizeMediaType(ct)]; ok {
+			return d, nil
+		}
+		return r.defaultDecoder(), nil
+	} else if err != nil {
+		params = nil
+	}
+	for _, key := range mediaTypeCandidates(mt) {
+		if d, ok := r.decoders[key]; ok {
+			return d, params
+		}
+	}
+	return r.defaultDecoder(), params
+}
+
+// RegisterEncoder registers e for contentType. contentType is interpreted in
+// the same way as RegisterDecoder.
+func (r *Registry) RegisterEncoder(contentType string, e Encoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoders[normalizeMediaType(contentType)] = e
+}
+
+// Encode encodes v as contentType. The returned content type includes the
+// parameters added by the encoder.
+func (r *Registry) Encode(contentType string, v interface{}) ([]byte, string, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, "", err
+	}
+	e := r.lookupEncoder(mt)
+	if e == nil {
+		return nil, "", ErrNoEncoder
+	}
+	pe, ok := e.(ParamEncoder)
+	if !ok {
+		b, err := e.Encode(v)
+		return b, contentType, err
+	}
+	b, err := pe.EncodeParams(v, params)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, mime.FormatMediaType(mt, params), nil
+}
+
+func (r *Registry) lookupEncoder(mt string) Encoder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range mediaTypeCandidates(mt) {
+		if e, ok := r.encoders[key]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func (r *Registry) defaultDecoder() Decoder {
+	if r.def != nil {
+		return r.def
+	}
+	return DefaultDecoder
+}
+
+func normalizeMediaType(ct string) string {
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ct))
+}
+
+func mediaTypeCandidates(mt string) []string {
+	keys := []string{mt}
+	if i := strings.LastIndex(mt, "+"); i >= 0 {
+		keys = append(keys, mt[i:])
+	}
+	if i := strings.Index(mt, "/"); i >= 0 {
+		keys = append(keys, mt[:i]+"/*")
+	}
+	return append(keys, "*/*")
+}
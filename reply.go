@@ -0,0 +1,126 @@
+package lmq
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrReplied is returned when replying to a message which has already
+	// been acked or nacked.
+	ErrReplied = errors.New("lmq: message already replied")
+	// ErrNoClient is returned when replying by a message which was not
+	// pulled by a client or bound to one.
+	ErrNoClient = errors.New("lmq: message has no client")
+)
+
+// Outcome is the last reply made to a message and its result.
+type Outcome struct {
+	Reply ReplyType
+	Err   error
+}
+
+// replyState tracks replies to a message. Ext may be sent any number of
+// times until the message is acked or nacked. It is kept behind a pointer,
+// set when a message is pulled or unmarshaled, so that copies of a Message
+// share it.
+type replyState struct {
+	mu      sync.Mutex
+	final   bool
+	outcome *Outcome
+}
+
+// replyStateMu guards the creation of reply states on first use.
+var replyStateMu sync.Mutex
+
+// state returns the reply state of m. Messages made by composite literals
+// get one on first use.
+func (m *Message) state() *replyState {
+	if rs := m.rs; rs != nil {
+		return rs
+	}
+	replyStateMu.Lock()
+	defer replyStateMu.Unlock()
+	if m.rs == nil {
+		m.rs = new(replyState)
+	}
+	return m.rs
+}
+
+// Bind makes m reply by c, e.g. after m has been unmarshaled in another
+// process. m decodes by the registry of c from then on, as if c had pulled it.
+func (m *Message) Bind(c Client) {
+	m.client = c
+	m.reg = registryOf(c, nil)
+	if m.part != nil {
+		m.part.reg = m.reg
+	}
+}
+
+// Ack acks m by the client which pulled it.
+func (m *Message) Ack() error {
+	return m.reply(ReplyAck)
+}
+
+// Nack nacks m by the client which pulled it.
+func (m *Message) Nack() error {
+	return m.reply(ReplyNack)
+}
+
+// Extend extends the timeout of m by the client which pulled it.
+func (m *Message) Extend() error {
+	return m.reply(ReplyExt)
+}
+
+func (m *Message) reply(r ReplyType) error {
+	if m.client == nil {
+		return ErrNoClient
+	}
+	return m.client.Reply(m, r)
+}
+
+// Replied reports whether m has been acked or nacked successfully.
+func (m *Message) Replied() bool {
+	rs := m.state()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.final
+}
+
+// Outcome returns the last reply made to m, or nil if there is none.
+func (m *Message) Outcome() *Outcome {
+	rs := m.state()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.outcome == nil {
+		return nil
+	}
+	o := *rs.outcome
+	return &o
+}
+
+// beginReply claims m for reply r. Ack and nack are claimed exclusively so
+// that concurrent replies are detected too.
+func (m *Message) beginReply(r ReplyType) error {
+	rs := m.state()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.final {
+		return ErrReplied
+	}
+	if r != ReplyExt {
+		rs.final = true
+	}
+	return nil
+}
+
+// endReply records the result of r. A failed ack or nack can be retried.
+func (m *Message) endReply(r ReplyType, err error) {
+	rs := m.state()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err != nil && r != ReplyExt {
+		rs.final = false
+	}
+	rs.outcome = &Outcome{Reply: r, Err: err}
+}
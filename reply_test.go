@@ -0,0 +1,74 @@
+package lmq
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageReply(t *testing.T) {
+	queue := "TestMessageReply"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	for _, body := range []string{"a", "b"} {
+		_, err := c.Push(queue, "text/plain", strings.NewReader(body))
+		must(t, err)
+	}
+
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	assert.False(t, m.Replied())
+	assert.Nil(t, m.Outcome())
+	must(t, m.Extend())
+	assert.False(t, m.Replied())
+	assert.Equal(t, &Outcome{Reply: ReplyExt}, m.Outcome())
+	must(t, m.Nack())
+	assert.True(t, m.Replied())
+	assert.Equal(t, ErrReplied, m.Ack())
+	assert.Equal(t, ErrReplied, c.Reply(m, ReplyAck))
+	assert.Equal(t, &Outcome{Reply: ReplyNack}, m.Outcome())
+
+	// A failed reply is recorded and can be retried.
+	m, err = c.Pull(queue, 0)
+	must(t, err)
+	id := m.ID
+	m.ID = "unknown"
+	assert.NotNil(t, m.Ack())
+	assert.False(t, m.Replied())
+	assert.Equal(t, ReplyAck, m.Outcome().Reply)
+	assert.IsType(t, &Error{}, m.Outcome().Err)
+	m.ID = id
+	cp := *m
+	must(t, m.Ack())
+	assert.True(t, cp.Replied())
+	assert.Equal(t, ErrReplied, cp.Ack())
+
+	assert.Equal(t, ErrNoClient, (&Message{}).Ack())
+
+	// A copy taken before the first reply shares the state too.
+	_, err = c.Push(queue, "text/plain", strings.NewReader("c"))
+	must(t, err)
+	m, err = c.Pull(queue, 0)
+	must(t, err)
+	early := *m
+	must(t, m.Ack())
+	assert.Equal(t, ErrReplied, early.Ack())
+}
+
+func TestReplierSkipsReplied(t *testing.T) {
+	queue := "TestReplierSkipsReplied"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	_, err := c.Push(queue, "text/plain", strings.NewReader("a"))
+	must(t, err)
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+
+	h := Chain(HandlerFunc(func(ctx context.Context, m *Message) error {
+		return m.Nack()
+	}), Replier(c))
+	assert.Nil(t, h.HandleMessage(context.Background(), m))
+	assert.Equal(t, ReplyNack, m.Outcome().Reply)
+}
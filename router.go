@@ -0,0 +1,132 @@
+package lmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var ErrNoRoute = errors.New("lmq: no route for queue")
+
+type route struct {
+	re     *regexp.Regexp
+	prefix string
+	h      Handler
+}
+
+// Router dispatches messages to handlers by their queue names. It is meant to
+// be used with PullAny on the pattern returned by Pattern. A handler
+// registered for the exact queue name takes precedence, followed by the
+// regular expression with the longest literal prefix and then the one
+// registered first. Messages without a route are passed to NotFound, which
+// returns ErrNoRoute by default so that the message is nacked.
+type Router struct {
+	NotFound Handler
+
+	mu     sync.RWMutex
+	exact  map[string]Handler
+	routes []*route
+}
+
+func NewRouter() *Router {
+	return &Router{exact: make(map[string]Handler)}
+}
+
+// Handle registers h for the queue named queue.
+func (r *Router) Handle(queue string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exact[queue] = h
+}
+
+// HandleRegexp registers h for queues matching pattern.
+func (r *Router) HandleRegexp(pattern string, h Handler) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, &route{re: re, prefix: literalPrefix(pattern), h: h})
+	return nil
+}
+
+// literalPrefix returns the literal string which all queue names matching
+// pattern start with. LiteralPrefix of regexp does not see through anchors.
+func literalPrefix(pattern string) string {
+	if !strings.HasPrefix(pattern, "^") {
+		return ""
+	}
+	re, err := regexp.Compile(pattern[1:])
+	if err != nil {
+		return ""
+	}
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
+// matchNothing is a regular expression which matches no queue name.
+const matchNothing = `[^\s\S]`
+
+// Pattern returns a regular expression matching all routed queues. Without
+// routes, it matches nothing rather than every queue.
+func (r *Router) Pattern() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var alts []string
+	for name := range r.exact {
+		alts = append(alts, "^"+regexp.QuoteMeta(name)+"$")
+	}
+	for _, rt := range r.routes {
+		alts = append(alts, "(?:"+rt.re.String()+")")
+	}
+	if len(alts) == 0 {
+		return matchNothing
+	}
+	return strings.Join(alts, "|")
+}
+
+// Lookup returns the handler for queue, or nil if there is no route.
+func (r *Router) Lookup(queue string) Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if h, ok := r.exact[queue]; ok {
+		return h
+	}
+	var best *route
+	for _, rt := range r.routes {
+		if rt.re.MatchString(queue) && (best == nil || len(rt.prefix) > len(best.prefix)) {
+			best = rt
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.h
+}
+
+func (r *Router) HandleMessage(ctx context.Context, m *Message) error {
+	if h := r.Lookup(m.Queue); h != nil {
+		return h.HandleMessage(ctx, m)
+	}
+	if r.NotFound != nil {
+		return r.NotFound.HandleMessage(ctx, m)
+	}
+	return ErrNoRoute
+}
+
+// DeadLetterHandler pushes messages to queue as they are. It is useful as
+// Router.NotFound.
+func DeadLetterHandler(c Client, queue string) Handler {
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		return deadLetter(c, queue, m)
+	})
+}
+
+func deadLetter(c Client, queue string, m *Message) error {
+	_, err := c.Push(queue, m.ContentType, bytes.NewReader(m.Body))
+	return err
+}
@@ -0,0 +1,110 @@
+package lmq
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func routeTo(name string, got *string) Handler {
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		*got = name
+		return nil
+	})
+}
+
+func TestRouterLookup(t *testing.T) {
+	var got string
+	r := NewRouter()
+	r.Handle("orders:vip", routeTo("exact", &got))
+	must(t, r.HandleRegexp("^orders:.*", routeTo("orders", &got)))
+	must(t, r.HandleRegexp("^orders:eu:.*", routeTo("orders:eu", &got)))
+	must(t, r.HandleRegexp("^.*", routeTo("all", &got)))
+	assert.NotNil(t, r.HandleRegexp("(", nil))
+
+	for queue, want := range map[string]string{
+		"orders:vip":   "exact",
+		"orders:us:1":  "orders",
+		"orders:eu:1":  "orders:eu",
+		"payments:eu1": "all",
+	} {
+		got = ""
+		must(t, r.HandleMessage(context.Background(), &Message{Queue: queue}))
+		assert.Equal(t, want, got, queue)
+	}
+
+	re := regexp.MustCompile(r.Pattern())
+	assert.True(t, re.MatchString("orders:vip"))
+	assert.True(t, re.MatchString("anything"))
+}
+
+func TestRouterNotFound(t *testing.T) {
+	r := NewRouter()
+	r.Handle("a.b", HandlerFunc(func(ctx context.Context, m *Message) error { return nil }))
+	assert.Equal(t, "^a\\.b$", r.Pattern())
+	assert.Equal(t, ErrNoRoute, r.HandleMessage(context.Background(), &Message{Queue: "axb"}))
+}
+
+func TestRouterEmptyPattern(t *testing.T) {
+	queue := "TestRouterEmptyPattern"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	_, err := c.Push(queue, "text/plain", strings.NewReader("x"))
+	must(t, err)
+
+	pattern := NewRouter().Pattern()
+	for _, name := range []string{"", "a", queue} {
+		assert.False(t, regexp.MustCompile(pattern).MatchString(name), name)
+	}
+	_, err = c.PullAny(pattern, 0)
+	assert.True(t, isEmpty(err))
+}
+
+func TestRouterConsumer(t *testing.T) {
+	c := New(lmqURL)
+	queues := []string{"TestRouter:a", "TestRouter:b", "TestRouter:c"}
+	for _, q := range queues {
+		c.Pull(q, 0)
+		defer c.Delete(q)
+	}
+	defer c.Delete("TestRouter:dead")
+
+	got := make(chan string, 10)
+	r := NewRouter()
+	r.Handle("TestRouter:a", HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- "a:" + string(m.Body)
+		return nil
+	}))
+	must(t, r.HandleRegexp("^TestRouter:[b]$", HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- "b:" + string(m.Body)
+		return nil
+	})))
+	r.NotFound = DeadLetterHandler(c, "TestRouter:dead")
+
+	_, err := c.PushAll("^TestRouter:[abc]$", "text/plain", strings.NewReader("x"))
+	must(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer := NewConsumer(c, "^TestRouter:[abc]$", Chain(r, Replier(c)))
+	consumer.Any = true
+	go consumer.Run(ctx)
+
+	var routed []string
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-got:
+			routed = append(routed, s)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	assert.ElementsMatch(t, []string{"a:x", "b:x"}, routed)
+	m, err := c.Pull("TestRouter:dead", 2*time.Second)
+	must(t, err)
+	assert.Equal(t, "x", string(m.Body))
+}
@@ -0,0 +1,285 @@
+package lmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"sync"
+	"time"
+)
+
+// Content type parameters which carry RPC metadata along with requests and
+// responses.
+const (
+	ReplyToParam       = "reply-to"
+	CorrelationIDParam = "correlation-id"
+	RPCErrorParam      = "rpc-error"
+)
+
+var ErrRPCClosed = errors.New("lmq: rpc client closed")
+
+// RPCPollTimeout is the long polling timeout used while waiting for messages.
+// The context is checked between polls.
+var RPCPollTimeout = time.Second
+
+// RPCError is returned by RPCClient.Call when the handler of the request
+// returned an error.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "lmq: rpc error: " + e.Message
+}
+
+// RPCClient calls remote procedures served by RPCServer.
+//
+// If ReplyQueue is empty, each call creates a unique reply queue and deletes
+// it when the call returns. Otherwise responses for all calls are received on
+// ReplyQueue and matched to the calls by correlation IDs; the queue must not
+// be shared with other RPCClients, since responses for unknown calls are
+// dropped.
+type RPCClient struct {
+	Client      Client
+	ContentType string
+	ReplyQueue  string
+
+	once    sync.Once
+	mu      sync.Mutex
+	waiters map[string]chan *Message
+	done    chan struct{}
+	err     error
+}
+
+// NewRPCClient creates an RPCClient which encodes requests as contentType.
+func NewRPCClient(c Client, contentType string) *RPCClient {
+	return &RPCClient{Client: c, ContentType: contentType}
+}
+
+// Call pushes req to queue and waits for the response, which is decoded into
+// resp. resp may be nil to discard the response.
+func (c *RPCClient) Call(ctx context.Context, queue string, req, resp interface{}) error {
+	id := newCorrelationID()
+	replyTo := c.ReplyQueue
+	var ch chan *Message
+	if replyTo == "" {
+		replyTo = "lmq-rpc-reply:" + id
+		defer c.Client.Delete(replyTo)
+	} else {
+		c.once.Do(c.start)
+		ch = make(chan *Message, 1)
+		if err := c.wait(id, ch); err != nil {
+			return err
+		}
+		defer c.unwait(id)
+	}
+
+	ct, err := withParams(c.ContentType, map[string]string{
+		ReplyToParam:       replyTo,
+		CorrelationIDParam: id,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := PushValue(c.Client, nil, queue, ct, req); err != nil {
+		return err
+	}
+
+	var m *Message
+	if ch == nil {
+		m, err = c.receive(ctx, replyTo, id)
+	} else {
+		select {
+		case m = <-ch:
+		case <-c.done:
+			err = ErrRPCClosed
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if msg := contentTypeParam(m.ContentType, RPCErrorParam); msg != "" {
+		return &RPCError{Message: msg}
+	}
+	if resp == nil {
+		return nil
+	}
+	return m.Decode(resp)
+}
+
+// receive pulls the response for id from a unique reply queue.
+func (c *RPCClient) receive(ctx context.Context, queue, id string) (*Message, error) {
+	for {
+		m, err := c.Client.Pull(queue, RPCPollTimeout)
+		switch {
+		case err == nil:
+			c.Client.Reply(m, ReplyAck)
+			if contentTypeParam(m.ContentType, CorrelationIDParam) == id {
+				return m, nil
+			}
+		case !isEmpty(err):
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *RPCClient) start() {
+	c.waiters = make(map[string]chan *Message)
+	c.done = make(chan struct{})
+	go c.dispatch()
+}
+
+// dispatch receives responses on the shared reply queue until Close is
+// called.
+func (c *RPCClient) dispatch() {
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		m, err := c.Client.Pull(c.ReplyQueue, RPCPollTimeout)
+		if err != nil {
+			if !isEmpty(err) {
+				time.Sleep(RPCPollTimeout)
+			}
+			continue
+		}
+		c.Client.Reply(m, ReplyAck)
+		c.mu.Lock()
+		ch, ok := c.waiters[contentTypeParam(m.ContentType, CorrelationIDParam)]
+		c.mu.Unlock()
+		if ok {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (c *RPCClient) wait(id string, ch chan *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.waiters[id] = ch
+	return nil
+}
+
+func (c *RPCClient) unwait(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.waiters, id)
+}
+
+// Close stops receiving responses on the shared reply queue and deletes it.
+// Pending calls fail with ErrRPCClosed.
+func (c *RPCClient) Close() error {
+	if c.ReplyQueue == "" {
+		return nil
+	}
+	c.once.Do(c.start)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	c.err = ErrRPCClosed
+	close(c.done)
+	return c.Client.Delete(c.ReplyQueue)
+}
+
+// RPCHandler handles a request and returns the response to be pushed.
+type RPCHandler func(context.Context, *Message) (interface{}, error)
+
+// RPCServer serves requests pushed to Queue by RPCClient. Responses are
+// encoded as ContentType.
+type RPCServer struct {
+	Client      Client
+	Queue       string
+	ContentType string
+	Handler     RPCHandler
+}
+
+// Serve handles requests until ctx is done.
+func (s *RPCServer) Serve(ctx context.Context) error {
+	for {
+		m, err := s.Client.Pull(s.Queue, RPCPollTimeout)
+		switch {
+		case err == nil:
+			if err := s.handle(ctx, m); err != nil {
+				s.Client.Reply(m, ReplyNack)
+			} else {
+				s.Client.Reply(m, ReplyAck)
+			}
+		case !isEmpty(err):
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *RPCServer) handle(ctx context.Context, m *Message) error {
+	replyTo := contentTypeParam(m.ContentType, ReplyToParam)
+	if replyTo == "" {
+		return nil
+	}
+	params := map[string]string{CorrelationIDParam: contentTypeParam(m.ContentType, CorrelationIDParam)}
+	ct := s.ContentType
+	resp, err := s.Handler(ctx, m)
+	if err != nil {
+		ct, resp = "text/plain", ""
+		params[RPCErrorParam] = err.Error()
+	}
+	ct, err = withParams(ct, params)
+	if err != nil {
+		return err
+	}
+	_, err = PushValue(s.Client, nil, replyTo, ct, resp)
+	return err
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withParams adds params to the content type ct.
+func withParams(ct string, params map[string]string) (string, error) {
+	mt, p, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range params {
+		p[k] = v
+	}
+	if ct = mime.FormatMediaType(mt, p); ct == "" {
+		return "", ErrEncode
+	}
+	return ct, nil
+}
+
+func contentTypeParam(ct, name string) string {
+	_, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+	return params[name]
+}
+
+func isEmpty(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.IsEmpty()
+}
@@ -0,0 +1,92 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type rpcRequest struct {
+	Name string
+}
+
+type rpcResponse struct {
+	Greeting string
+}
+
+func startRPCServer(t *testing.T, queue string) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &RPCServer{
+		Client:      New(lmqURL),
+		Queue:       queue,
+		ContentType: "application/json",
+		Handler: func(ctx context.Context, m *Message) (interface{}, error) {
+			var req rpcRequest
+			if err := m.Decode(&req); err != nil {
+				return nil, err
+			}
+			if req.Name == "" {
+				return nil, errors.New("name required")
+			}
+			return &rpcResponse{Greeting: "Hello " + req.Name}, nil
+		},
+	}
+	go s.Serve(ctx)
+	return cancel
+}
+
+func TestRPC(t *testing.T) {
+	queue := "TestRPC"
+	defer startRPCServer(t, queue)()
+	c := NewRPCClient(New(lmqURL), "application/json")
+
+	var resp rpcResponse
+	assert.Nil(t, c.Call(context.Background(), queue, &rpcRequest{Name: "LMQ"}, &resp))
+	assert.Equal(t, "Hello LMQ", resp.Greeting)
+
+	err := c.Call(context.Background(), queue, &rpcRequest{}, &resp)
+	assert.Equal(t, &RPCError{Message: "name required"}, err)
+}
+
+func TestRPCSharedReplyQueue(t *testing.T) {
+	queue := "TestRPCSharedReplyQueue"
+	defer startRPCServer(t, queue)()
+	c := NewRPCClient(New(lmqURL), "application/json")
+	c.ReplyQueue = "TestRPCSharedReplyQueue:reply"
+	defer c.Close()
+
+	names := []string{"a", "b", "c", "d"}
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			var resp rpcResponse
+			err := c.Call(context.Background(), queue, &rpcRequest{Name: name}, &resp)
+			if err == nil && resp.Greeting != "Hello "+name {
+				err = errors.New("mismatched response: " + resp.Greeting)
+			}
+			errs <- err
+		}(name)
+	}
+	for range names {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	c := NewRPCClient(New(lmqURL), "application/json")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	defer c.Client.Delete("TestRPCTimeout")
+	err := c.Call(ctx, "TestRPCTimeout", &rpcRequest{Name: "LMQ"}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	m, err := c.Client.Pull("TestRPCTimeout", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(contentTypeParam(m.ContentType, ReplyToParam), "lmq-rpc-reply:"))
+}
@@ -0,0 +1,184 @@
+// Package schema validates JSON message bodies against JSON Schemas before
+// they are decoded.
+//
+// Producers attach a schema ID to a message by the "schema" parameter of its
+// content type (see ContentType), or by the "schema" metadata of a compound
+// part. Register installs validating decoders to an lmq.Registry, so that
+// Message.Decode rejects bodies which do not conform to their schema with
+// *ValidationError.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/yosisa/go-lmq"
+)
+
+// Param is the content type parameter carrying the schema ID.
+const Param = "schema"
+
+var ErrUnknownSchema = errors.New("schema: unknown schema")
+
+// ContentType adds the schema ID to contentType.
+func ContentType(contentType, id string) (string, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	params[Param] = id
+	return mime.FormatMediaType(mt, params), nil
+}
+
+// Registry looks up schemas by ID.
+type Registry interface {
+	Lookup(id string) (*Schema, error)
+}
+
+type Schema struct {
+	id string
+	s  *jsonschema.Schema
+}
+
+// Compile compiles a JSON Schema document. References to other documents are
+// not resolved.
+func Compile(id string, doc []byte) (*Schema, error) {
+	u := "lmq-schema:///" + url.PathEscape(id)
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema: cannot load %s", s)
+	}
+	if err := c.AddResource(u, bytes.NewReader(doc)); err != nil {
+		return nil, err
+	}
+	s, err := c.Compile(u)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{id: id, s: s}, nil
+}
+
+// Validate validates a JSON document. A document which does not conform to
+// the schema is reported as *ValidationError.
+func (s *Schema) Validate(b []byte) error {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	err := s.s.Validate(v)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	e := &ValidationError{SchemaID: s.id}
+	for _, be := range ve.BasicOutput().Errors {
+		// The basic output includes the errors of the enclosing schemas,
+		// which only say that their subschemas failed.
+		if strings.HasPrefix(be.Error, "doesn't validate with") {
+			continue
+		}
+		e.Failures = append(e.Failures, Failure{Path: be.InstanceLocation, Message: be.Error})
+	}
+	return e
+}
+
+// Failure describes why the value at Path, a JSON Pointer, is invalid.
+type Failure struct {
+	Path    string
+	Message string
+}
+
+type ValidationError struct {
+	SchemaID string
+	Failures []Failure
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		path := f.Path
+		if path == "" {
+			path = "/"
+		}
+		msgs[i] = path + ": " + f.Message
+	}
+	return fmt.Sprintf("schema: validation against %q failed: %s", e.SchemaID, strings.Join(msgs, "; "))
+}
+
+// MemoryRegistry is a Registry which keeps schemas in memory.
+type MemoryRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*Schema
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{schemas: make(map[string]*Schema)}
+}
+
+// Register compiles doc and registers it as id.
+func (r *MemoryRegistry) Register(id string, doc []byte) error {
+	s, err := Compile(id, doc)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[id] = s
+	return nil
+}
+
+func (r *MemoryRegistry) Lookup(id string) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.schemas[id]; ok {
+		return s, nil
+	}
+	return nil, ErrUnknownSchema
+}
+
+// Register wraps the decoders of contentTypes in reg so that bodies carrying a
+// schema ID are validated by the schema from schemas before being decoded.
+// contentTypes defaults to "application/json" and "+json".
+func Register(reg *lmq.Registry, schemas Registry, contentTypes ...string) {
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json", "+json"}
+	}
+	for _, ct := range contentTypes {
+		reg.RegisterDecoder(ct, &decoder{next: reg.Decoder(ct), schemas: schemas})
+	}
+}
+
+type decoder struct {
+	next    lmq.Decoder
+	schemas Registry
+}
+
+func (d *decoder) Decode(b []byte, v interface{}) error {
+	return d.next.Decode(b, v)
+}
+
+func (d *decoder) DecodeParams(b []byte, params map[string]string, v interface{}) error {
+	if id := params[Param]; id != "" {
+		s, err := d.schemas.Lookup(id)
+		if err != nil {
+			return err
+		}
+		if err := s.Validate(b); err != nil {
+			return err
+		}
+	}
+	if pd, ok := d.next.(lmq.ParamDecoder); ok {
+		return pd.DecodeParams(b, params, v)
+	}
+	return d.next.Decode(b, v)
+}
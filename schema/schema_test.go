@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/go-lmq"
+	"github.com/yosisa/go-lmq/lmqtest"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"properties": {
+		"id": {"type": "integer"},
+		"items": {"type": "array", "items": {"type": "string"}}
+	}
+}`
+
+func newRegistry(t *testing.T) *lmq.Registry {
+	schemas := NewMemoryRegistry()
+	if err := schemas.Register("order.v1", []byte(orderSchema)); err != nil {
+		t.Fatal(err)
+	}
+	reg := lmq.DefaultRegistry.Clone()
+	Register(reg, schemas)
+	return reg
+}
+
+func TestValidate(t *testing.T) {
+	s := lmqtest.NewServer()
+	defer s.Close()
+	queue := "TestValidate"
+	c := lmq.New(s.URL, lmq.WithRegistry(newRegistry(t)))
+
+	ct, err := ContentType("application/json", "order.v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lmq.PushValue(c, nil, queue, ct, map[string]interface{}{"id": 1, "items": []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lmq.PushValue(c, nil, queue, ct, map[string]interface{}{"id": "1", "items": []interface{}{"a", 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		ID    int
+		Items []string
+	}
+	m, err := c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, m.Decode(&v))
+	assert.Equal(t, 1, v.ID)
+
+	m, err = c.Pull(queue, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Decode(&v)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "order.v1", ve.SchemaID)
+	var paths []string
+	for _, f := range ve.Failures {
+		paths = append(paths, f.Path)
+	}
+	assert.ElementsMatch(t, []string{"/id", "/items/1"}, paths)
+}
+
+func TestValidateUnknownSchema(t *testing.T) {
+	m := &lmq.Message{MessageType: "normal", ContentType: "application/vnd.order+json; schema=order.v2", Body: []byte(`{}`)}
+	var v interface{}
+	assert.Nil(t, m.Decode(&v))
+
+	reg := newRegistry(t)
+	r := reg.Decoder("application/vnd.order+json").(lmq.ParamDecoder)
+	assert.Equal(t, ErrUnknownSchema, r.DecodeParams([]byte(`{}`), map[string]string{"schema": "order.v2"}, &v))
+	assert.Nil(t, r.DecodeParams([]byte(`{}`), nil, &v))
+}
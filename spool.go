@@ -0,0 +1,600 @@
+package lmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSpoolFull     = errors.New("lmq: spool full")
+	ErrSpoolTooLarge = errors.New("lmq: message too large to spool")
+	errSpoolCorrupt  = errors.New("lmq: spool record corrupt")
+)
+
+// SyncPolicy determines when spooled messages are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs after every spooled message.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic syncs every SyncInterval, so a crash may lose the
+	// messages spooled since the last sync.
+	SyncPeriodic
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
+// SpoolOptions configures a SpoolingProducer. Zero values select the
+// defaults.
+type SpoolOptions struct {
+	// SegmentSize is the size at which a new segment file is started.
+	SegmentSize int64
+	// MaxSize limits the total size of the segment files. Pushes which
+	// would exceed it fail with ErrSpoolFull. Zero means unlimited.
+	MaxSize int64
+
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// FlushInterval is the time to wait before replaying again after the
+	// server failed.
+	FlushInterval time.Duration
+
+	// OnReject is called when the server rejects a replayed message with a
+	// client error, e.g. because its queue name is invalid. The message is
+	// dropped. Server errors, 429 Too Many Requests and ErrRateLimited are
+	// retried after FlushInterval instead.
+	OnReject func(queue, contentType string, body []byte, err error)
+}
+
+const (
+	defaultSegmentSize   = 16 << 20
+	spoolRecordHeaderLen = 8
+)
+
+// maxSpoolRecordSize limits the size of a record; larger records are
+// rejected by Push and PushAll with ErrSpoolTooLarge rather than written,
+// since recovery would take them for corruption.
+var maxSpoolRecordSize uint32 = 1 << 30
+
+// SpoolingProducer pushes messages by Client and, when a push fails with a
+// transport error, appends the message to a local spool instead of failing.
+// A background flusher replays the spool in order once the server is
+// reachable again. While the spool is not empty, new messages are spooled as
+// well to keep them in order.
+//
+// The spool is a directory of append-only segment files. Each record is
+// prefixed by its length and CRC-32C checksum, and a cursor file records how
+// far the spool has been replayed, so that messages survive crashes. Since
+// the cursor is updated after a message is pushed, a crash in between may
+// push the message twice.
+type SpoolingProducer struct {
+	Client Client
+
+	opts SpoolOptions
+	dir  string
+
+	mu    sync.Mutex
+	segs  []uint64 // ids of segment files, oldest first
+	w     *os.File
+	wsize int64
+	size  int64
+	count int
+	r     *os.File
+	roff  int64
+	dirty bool
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type spoolRecord struct {
+	all         bool
+	queue       string
+	contentType string
+	body        []byte
+}
+
+// NewSpoolingProducer opens or creates the spool in dir and starts replaying
+// it. Close must be called to stop the flusher.
+func NewSpoolingProducer(c Client, dir string, opts SpoolOptions) (*SpoolingProducer, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &SpoolingProducer{
+		Client: c,
+		opts:   opts,
+		dir:    dir,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// recover loads the segments, skipping replayed ones, and truncates a torn
+// record left at the end of the last segment by a crash.
+func (p *SpoolingProducer) recover() error {
+	cseg, coff, err := p.readCursor()
+	if err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(p.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if id < cseg {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		p.segs = append(p.segs, id)
+	}
+	sort.Slice(p.segs, func(i, j int) bool { return p.segs[i] < p.segs[j] })
+	if len(p.segs) > 0 && p.segs[0] == cseg {
+		p.roff = coff
+	}
+	for i, id := range p.segs {
+		off := int64(0)
+		if i == 0 {
+			off = p.roff
+		}
+		f, err := os.Open(p.segPath(id))
+		if err != nil {
+			return err
+		}
+		end, n := scanSegment(f, off)
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return err
+		}
+		size := fi.Size()
+		if i == len(p.segs)-1 && end < size {
+			if err := os.Truncate(p.segPath(id), end); err != nil {
+				return err
+			}
+			size = end
+		}
+		p.count += n
+		p.size += size
+		p.wsize = size
+	}
+	if len(p.segs) == 0 {
+		p.segs = []uint64{cseg + 1}
+		p.roff = 0
+	}
+	p.w, err = os.OpenFile(p.segPath(p.segs[len(p.segs)-1]), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+// scanSegment returns the end of the valid records from off and their number.
+func scanSegment(f *os.File, off int64) (int64, int) {
+	n := 0
+	for {
+		_, size, err := readSpoolRecord(f, off)
+		if err != nil {
+			return off, n
+		}
+		off += size
+		n++
+	}
+}
+
+func (p *SpoolingProducer) segPath(id uint64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+func (p *SpoolingProducer) cursorPath() string {
+	return filepath.Join(p.dir, "cursor")
+}
+
+func (p *SpoolingProducer) readCursor() (uint64, int64, error) {
+	b, err := ioutil.ReadFile(p.cursorPath())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	var seg uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seg, &off); err != nil {
+		return 0, 0, nil
+	}
+	return seg, off, nil
+}
+
+// writeCursor replaces the cursor file atomically.
+func (p *SpoolingProducer) writeCursor() error {
+	tmp := p.cursorPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", p.segs[0], p.roff); err != nil {
+		f.Close()
+		return err
+	}
+	if p.opts.Sync == SyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.cursorPath())
+}
+
+// Push pushes body to queue, or spools it if LMQ is unreachable. The
+// response of a spooled message is empty.
+func (p *SpoolingProducer) Push(queue, bodyType string, body io.Reader) (*PushResponse, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if p.Len() == 0 {
+		r, err := p.Client.Push(queue, bodyType, bytes.NewReader(b))
+		if !isTransportError(err) {
+			return r, err
+		}
+	}
+	if err := p.append(&spoolRecord{queue: queue, contentType: bodyType, body: b}); err != nil {
+		return nil, err
+	}
+	return &PushResponse{}, nil
+}
+
+// PushAll is like Push but pushes to all queues matching queue. The response
+// of a spooled message is empty.
+func (p *SpoolingProducer) PushAll(queue, bodyType string, body io.Reader) (map[string]*PushResponse, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if p.Len() == 0 {
+		r, err := p.Client.PushAll(queue, bodyType, bytes.NewReader(b))
+		if !isTransportError(err) {
+			return r, err
+		}
+	}
+	if err := p.append(&spoolRecord{all: true, queue: queue, contentType: bodyType, body: b}); err != nil {
+		return nil, err
+	}
+	return map[string]*PushResponse{}, nil
+}
+
+// isTransportError reports whether err means that LMQ could not be reached,
+// as opposed to an error response.
+func isTransportError(err error) bool {
+	var uerr *url.Error
+	return errors.As(err, &uerr) || errors.Is(err, ErrCircuitOpen)
+}
+
+// isRetryable reports whether a replayed message which failed with err should
+// be kept and retried: LMQ is unreachable, unavailable (e.g. a 502 or 503 from
+// a proxy while it restarts) or rate limits the client. Messages rejected by
+// other client errors are dropped.
+func isRetryable(err error) bool {
+	var lerr *Error
+	if errors.As(err, &lerr) {
+		return lerr.Code >= 500 || lerr.Code == http.StatusTooManyRequests
+	}
+	return isTransportError(err) || errors.Is(err, ErrRateLimited)
+}
+
+// Len returns the number of spooled messages.
+func (p *SpoolingProducer) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+func (p *SpoolingProducer) append(r *spoolRecord) error {
+	b := r.marshal()
+	if int64(len(b)-spoolRecordHeaderLen) > int64(maxSpoolRecordSize) {
+		return ErrSpoolTooLarge
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.opts.MaxSize > 0 && p.size+int64(len(b)) > p.opts.MaxSize {
+		return ErrSpoolFull
+	}
+	if p.wsize > 0 && p.wsize+int64(len(b)) > p.opts.SegmentSize {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := p.w.Write(b); err != nil {
+		// Cut off a partial record so that later ones are not written
+		// after garbage, which recovery would drop with it.
+		p.w.Truncate(p.wsize)
+		return err
+	}
+	p.wsize += int64(len(b))
+	p.size += int64(len(b))
+	p.count++
+	switch p.opts.Sync {
+	case SyncAlways:
+		if err := p.w.Sync(); err != nil {
+			return err
+		}
+	case SyncPeriodic:
+		p.dirty = true
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (p *SpoolingProducer) rotate() error {
+	if p.opts.Sync != SyncNever {
+		if err := p.w.Sync(); err != nil {
+			return err
+		}
+	}
+	p.w.Close()
+	id := p.segs[len(p.segs)-1] + 1
+	f, err := os.OpenFile(p.segPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	p.w, p.wsize, p.dirty = f, 0, false
+	p.segs = append(p.segs, id)
+	return nil
+}
+
+func (p *SpoolingProducer) run() {
+	defer p.wg.Done()
+	var tick <-chan time.Time
+	if p.opts.Sync == SyncPeriodic {
+		t := time.NewTicker(p.opts.SyncInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		wake, retry := p.wake, (<-chan time.Time)(nil)
+		if err := p.flush(); err != nil {
+			// Do not hammer the server on every new message while it
+			// is down.
+			wake, retry = nil, time.After(p.opts.FlushInterval)
+		}
+		select {
+		case <-p.done:
+			return
+		case <-wake:
+		case <-retry:
+		case <-tick:
+			p.sync()
+		}
+	}
+}
+
+// flush replays the spool until it is empty, pushing fails or p is closed.
+func (p *SpoolingProducer) flush() error {
+	for {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+		p.mu.Lock()
+		r, next, err := p.peek()
+		p.mu.Unlock()
+		if err != nil || r == nil {
+			return err
+		}
+		if err := r.push(p.Client); err != nil {
+			if isRetryable(err) {
+				return err
+			}
+			if p.opts.OnReject != nil {
+				p.opts.OnReject(r.queue, r.contentType, r.body, err)
+			}
+		}
+		p.mu.Lock()
+		err = p.advance(next)
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// peek reads the oldest spooled message and returns it with the offset of the
+// next one. Exhausted segments are removed on the way.
+func (p *SpoolingProducer) peek() (*spoolRecord, int64, error) {
+	for p.count > 0 {
+		if p.r == nil {
+			f, err := os.Open(p.segPath(p.segs[0]))
+			if err != nil {
+				return nil, 0, err
+			}
+			p.r = f
+		}
+		r, n, err := readSpoolRecord(p.r, p.roff)
+		if err == nil {
+			return r, p.roff + n, nil
+		}
+		if len(p.segs) == 1 {
+			// Nothing readable is left; a record was lost to
+			// corruption.
+			p.count = 0
+			break
+		}
+		// The rest of a segment which is not written anymore is either
+		// replayed or corrupt.
+		if err := p.dropHead(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, nil
+}
+
+func (p *SpoolingProducer) dropHead() error {
+	fi, err := p.r.Stat()
+	if err != nil {
+		return err
+	}
+	p.r.Close()
+	p.r = nil
+	if err := os.Remove(p.segPath(p.segs[0])); err != nil {
+		return err
+	}
+	p.size -= fi.Size()
+	p.segs, p.roff = p.segs[1:], 0
+	return p.writeCursor()
+}
+
+func (p *SpoolingProducer) advance(next int64) error {
+	p.roff = next
+	p.count--
+	if p.count > 0 || len(p.segs) > 1 {
+		return p.writeCursor()
+	}
+	// Everything has been replayed, so start over to keep the segment from
+	// growing. The cursor is reset first; a crash in between replays the
+	// segment again rather than skipping new messages.
+	p.roff = 0
+	if err := p.writeCursor(); err != nil {
+		return err
+	}
+	if err := p.w.Truncate(0); err != nil {
+		return err
+	}
+	p.wsize, p.size = 0, 0
+	return nil
+}
+
+func (p *SpoolingProducer) sync() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dirty {
+		p.w.Sync()
+		p.dirty = false
+	}
+}
+
+// Close stops the flusher and closes the spool. Spooled messages are kept
+// for the next SpoolingProducer opened on the same directory.
+func (p *SpoolingProducer) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.r != nil {
+		p.r.Close()
+	}
+	if p.opts.Sync != SyncNever {
+		if err := p.w.Sync(); err != nil {
+			p.w.Close()
+			return err
+		}
+	}
+	return p.w.Close()
+}
+
+func (r *spoolRecord) push(c Client) error {
+	if r.all {
+		_, err := c.PushAll(r.queue, r.contentType, bytes.NewReader(r.body))
+		return err
+	}
+	_, err := c.Push(r.queue, r.contentType, bytes.NewReader(r.body))
+	return err
+}
+
+// marshal encodes r with the record header: the length and the CRC-32C of
+// the payload, followed by the payload of flags, queue, content type and body.
+func (r *spoolRecord) marshal() []byte {
+	b := make([]byte, spoolRecordHeaderLen, spoolRecordHeaderLen+1+2*binary.MaxVarintLen64+len(r.queue)+len(r.contentType)+len(r.body))
+	var flags byte
+	if r.all {
+		flags = 1
+	}
+	b = append(b, flags)
+	b = binary.AppendUvarint(b, uint64(len(r.queue)))
+	b = append(b, r.queue...)
+	b = binary.AppendUvarint(b, uint64(len(r.contentType)))
+	b = append(b, r.contentType...)
+	b = append(b, r.body...)
+	payload := b[spoolRecordHeaderLen:]
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	return b
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func readSpoolRecord(f *os.File, off int64) (*spoolRecord, int64, error) {
+	var hdr [spoolRecordHeaderLen]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n == 0 || n > maxSpoolRecordSize {
+		return nil, 0, errSpoolCorrupt
+	}
+	payload := make([]byte, n)
+	if _, err := f.ReadAt(payload, off+spoolRecordHeaderLen); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, 0, errSpoolCorrupt
+	}
+	r, err := unmarshalSpoolRecord(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, spoolRecordHeaderLen + int64(n), nil
+}
+
+func unmarshalSpoolRecord(b []byte) (*spoolRecord, error) {
+	r := &spoolRecord{all: b[0]&1 != 0}
+	b = b[1:]
+	for _, s := range []*string{&r.queue, &r.contentType} {
+		n, k := binary.Uvarint(b)
+		if k <= 0 || uint64(len(b)-k) < n {
+			return nil, errSpoolCorrupt
+		}
+		*s, b = string(b[k:k+int(n)]), b[k+int(n):]
+	}
+	r.body = b
+	return r, nil
+}
@@ -0,0 +1,252 @@
+package lmq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer proxies to the fake LMQ and drops connections while down.
+func flakyServer(t *testing.T, down *int32) *httptest.Server {
+	u, _ := url.Parse(lmqURL)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(down) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+}
+
+func pullBodies(t *testing.T, c Client, queue string) []string {
+	var bodies []string
+	for {
+		m, err := c.Pull(queue, 0)
+		if isEmpty(err) {
+			return bodies
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(m.Body))
+		c.Reply(m, ReplyAck)
+	}
+}
+
+func waitEmpty(t *testing.T, p *SpoolingProducer) {
+	for i := 0; p.Len() > 0; i++ {
+		if i == 100 {
+			t.Fatal("spool not flushed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSpoolingProducer(t *testing.T) {
+	queue := "TestSpoolingProducer"
+	var down int32
+	s := flakyServer(t, &down)
+	defer s.Close()
+	c := New(lmqURL)
+	defer c.Delete(queue)
+
+	p, err := NewSpoolingProducer(New(s.URL), t.TempDir(), SpoolOptions{
+		SegmentSize:   64,
+		FlushInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, err = p.Push(queue, "text/plain", strings.NewReader("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, p.Len())
+
+	atomic.StoreInt32(&down, 1)
+	for i := 1; i <= 5; i++ {
+		_, err := p.Push(queue, "text/plain", strings.NewReader(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 5, p.Len())
+	assert.Equal(t, []string{"0"}, pullBodies(t, c, queue))
+
+	atomic.StoreInt32(&down, 0)
+	_, err = p.Push(queue, "text/plain", strings.NewReader("6"))
+	assert.Nil(t, err)
+	waitEmpty(t, p)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, pullBodies(t, c, queue))
+
+	// Errors other than transport errors are not spooled.
+	_, err = p.PushAll("[", "text/plain", strings.NewReader("x"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, p.Len())
+}
+
+type scriptedPusher struct {
+	Client
+	mu     sync.Mutex
+	errs   []error
+	pushed []string
+}
+
+func (c *scriptedPusher) Push(queue, bodyType string, body io.Reader) (*PushResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	b, _ := ioutil.ReadAll(body)
+	c.pushed = append(c.pushed, string(b))
+	return &PushResponse{}, nil
+}
+
+func TestSpoolingProducerRetryable(t *testing.T) {
+	c := &scriptedPusher{errs: []error{
+		&url.Error{Op: "Post", URL: "http://lmq", Err: errors.New("refused")},
+		&Error{Code: http.StatusServiceUnavailable},
+		ErrRateLimited,
+		&Error{Code: http.StatusTooManyRequests},
+	}}
+	var rejected []error
+	p, err := NewSpoolingProducer(c, t.TempDir(), SpoolOptions{
+		FlushInterval: 10 * time.Millisecond,
+		OnReject:      func(_, _ string, _ []byte, err error) { rejected = append(rejected, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, err = p.Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	waitEmpty(t, p)
+	c.mu.Lock()
+	assert.Equal(t, []string{"x"}, c.pushed)
+	c.mu.Unlock()
+	assert.Empty(t, rejected)
+}
+
+func TestSpoolingProducerMaxSize(t *testing.T) {
+	p, err := NewSpoolingProducer(New("http://127.0.0.1:1"), t.TempDir(), SpoolOptions{
+		MaxSize:       100,
+		FlushInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	body := strings.Repeat("x", 40)
+	_, err = p.Push("q", "text/plain", strings.NewReader(body))
+	assert.Nil(t, err)
+	_, err = p.Push("q", "text/plain", strings.NewReader(body))
+	assert.Equal(t, ErrSpoolFull, err)
+	assert.Equal(t, 1, p.Len())
+}
+
+func TestSpoolingProducerTooLarge(t *testing.T) {
+	defer func(n uint32) { maxSpoolRecordSize = n }(maxSpoolRecordSize)
+	maxSpoolRecordSize = 64
+	dir := t.TempDir()
+	opts := SpoolOptions{FlushInterval: time.Minute}
+	p, err := NewSpoolingProducer(New("http://127.0.0.1:1"), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Push("q", "text/plain", strings.NewReader(strings.Repeat("x", 64)))
+	assert.Equal(t, ErrSpoolTooLarge, err)
+	_, err = p.PushAll("q", "text/plain", strings.NewReader(strings.Repeat("x", 64)))
+	assert.Equal(t, ErrSpoolTooLarge, err)
+	_, err = p.Push("q", "text/plain", strings.NewReader("x"))
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	p, err = NewSpoolingProducer(New("http://127.0.0.1:1"), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	assert.Equal(t, 1, p.Len())
+}
+
+func TestSpoolingProducerRecovery(t *testing.T) {
+	queue := "TestSpoolingProducerRecovery"
+	dir := t.TempDir()
+	down := int32(1)
+	s := flakyServer(t, &down)
+	defer s.Close()
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	opts := SpoolOptions{SegmentSize: 64, FlushInterval: 20 * time.Millisecond}
+
+	p, err := NewSpoolingProducer(New(s.URL), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		p.Push(queue, "text/plain", strings.NewReader(fmt.Sprint(i)))
+	}
+	assert.Nil(t, p.Close())
+
+	// Simulate a crash in the middle of appending a record.
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.True(t, len(segs) > 1)
+	f, err := os.OpenFile(segs[len(segs)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write((&spoolRecord{queue: queue, contentType: "text/plain", body: []byte("torn")}).marshal()[:12])
+	f.Close()
+
+	p, err = NewSpoolingProducer(New(s.URL), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 6, p.Len())
+	atomic.StoreInt32(&down, 0)
+	waitEmpty(t, p)
+	assert.Nil(t, p.Close())
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, pullBodies(t, c, queue))
+
+	// Replayed messages are not replayed again.
+	p, err = NewSpoolingProducer(New(s.URL), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, p.Len())
+	_, err = p.Push(queue, "text/plain", strings.NewReader("6"))
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+	assert.Equal(t, []string{"6"}, pullBodies(t, c, queue))
+}
+
+func TestSpoolRecordCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seg")
+	b := (&spoolRecord{queue: "q", contentType: "text/plain", body: []byte("hello")}).marshal()
+	b[len(b)-1] ^= 1
+	os.WriteFile(path, b, 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	_, _, err := readSpoolRecord(f, 0)
+	assert.Equal(t, errSpoolCorrupt, err)
+}
@@ -0,0 +1,128 @@
+package lmq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TransportOptions tunes the transport created by NewTransport. Zero values
+// select the defaults.
+type TransportOptions struct {
+	// MaxIdleConnsPerHost should be at least the number of concurrent
+	// pullers, or connections are closed and reopened between polls.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// H2C makes http:// URLs use HTTP/2 without TLS (prior knowledge), so
+	// that all requests share a few connections.
+	H2C bool
+	// TLSConfig is used for https URLs, see LoadTLSConfig.
+	TLSConfig *tls.Config
+}
+
+// DefaultTransport is shared by clients created without WithTransport.
+var DefaultTransport http.RoundTripper = NewTransport(TransportOptions{})
+
+// NewTransport returns a transport for LMQ clients. Since long polls hold a
+// connection each, it keeps more idle connections per host than
+// http.DefaultTransport.
+func NewTransport(o TransportOptions) *http.Transport {
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = 64
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = 90 * time.Second
+	}
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       o.TLSConfig,
+	}
+	if o.H2C {
+		var p http.Protocols
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+		t.Protocols = &p
+	}
+	return t
+}
+
+// WithTransport makes the client send requests by rt instead of
+// DefaultTransport. Timeouts are applied per request, so rt can be shared by
+// any number of clients.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *client) {
+		c.c = &http.Client{Transport: rt}
+	}
+}
+
+// unixBaseURL is the base URL of clients talking over a Unix socket. Its host
+// is ignored by the transport but keeps request URLs well formed.
+const unixBaseURL = "http://unix"
+
+func unixSocketPath(url string) (string, bool) {
+	if !strings.HasPrefix(url, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(url, "unix://"), true
+}
+
+// NewUnixTransport returns a transport which connects to the Unix socket at
+// path whatever the host of a request is. New uses it for unix:// URLs; give
+// it to WithTransport to tune it.
+func NewUnixTransport(path string, o TransportOptions) *http.Transport {
+	t := NewTransport(o)
+	t.Proxy = nil
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return t
+}
+
+// LoadTLSConfig returns a TLS configuration presenting the client certificate
+// in certFile and keyFile and trusting the CA certificates in caFile. Either
+// may be empty: no client certificate is presented without certFile, and the
+// system roots are trusted without caFile.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("lmq: no certificates in " + caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// WithTLSConfig makes the client use cfg for https URLs with an otherwise
+// default transport.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return WithTransport(NewTransport(TransportOptions{TLSConfig: cfg}))
+}
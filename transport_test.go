@@ -0,0 +1,193 @@
+package lmq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosisa/go-lmq/lmqtest"
+)
+
+func TestH2C(t *testing.T) {
+	var proto int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		w.Write([]byte(`{"accum":"no"}`))
+	}))
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetHTTP1(true)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	defer s.Close()
+
+	c := New(s.URL, WithTransport(NewTransport(TransportOptions{H2C: true})))
+	_, err := c.Push("q", "text/plain", strings.NewReader("x"))
+	must(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&proto))
+}
+
+func TestRequestDeadline(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+	defer func(d time.Duration) { DefaultTimeout = d }(DefaultTimeout)
+	DefaultTimeout = 50 * time.Millisecond
+
+	c := New(s.URL)
+	start := time.Now()
+	_, err := c.Pull("q", 0)
+	assert.NotNil(t, err)
+	assert.False(t, isEmpty(err))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lmq.sock")
+	l, err := net.Listen("unix", path)
+	must(t, err)
+	s := httptest.NewUnstartedServer(lmqtest.NewFakeLMQ())
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	c := New("unix://" + path)
+	queue := "TestUnixSocket/a"
+	_, err = c.Push(queue, "text/plain", strings.NewReader("hello"))
+	must(t, err)
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	assert.Equal(t, queue, m.Queue)
+	assert.Equal(t, "hello", string(m.Body))
+	must(t, m.Ack())
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil)
+	client, clientKey := newCert(t, ca, caKey)
+	writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", client.Raw)
+	b, err := x509.MarshalECPrivateKey(clientKey)
+	must(t, err)
+	writePEM(t, filepath.Join(dir, "client-key.pem"), "EC PRIVATE KEY", b)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	var subject string
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte(`{"accum":"no"}`))
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	s.StartTLS()
+	defer s.Close()
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", s.Certificate().Raw)
+
+	cfg, err := LoadTLSConfig(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), filepath.Join(dir, "ca.pem"))
+	must(t, err)
+	_, err = New(s.URL, WithTLSConfig(cfg)).Push("q", "text/plain", strings.NewReader("x"))
+	must(t, err)
+	assert.Equal(t, "client", subject)
+
+	// Without the client certificate the handshake fails.
+	cfg, err = LoadTLSConfig("", "", filepath.Join(dir, "ca.pem"))
+	must(t, err)
+	_, err = New(s.URL, WithTLSConfig(cfg)).Push("q", "text/plain", strings.NewReader("x"))
+	assert.NotNil(t, err)
+
+	_, err = LoadTLSConfig("", "", filepath.Join(dir, "client-key.pem"))
+	assert.NotNil(t, err)
+}
+
+// newCert creates a CA certificate if parent is nil, and a client
+// certificate signed by parent otherwise.
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.Subject.CommonName = "client"
+		tmpl.IsCA = false
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	must(t, err)
+	cert, err := x509.ParseCertificate(der)
+	must(t, err)
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	must(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600))
+}
+
+func BenchmarkConcurrentPull(b *testing.B) {
+	for _, pullers := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("pullers=%d", pullers), func(b *testing.B) {
+			queue := fmt.Sprintf("BenchmarkConcurrentPull%d", pullers)
+			c := New(lmqURL)
+			defer c.Delete(queue)
+			// One extra message per puller lets each of them see that
+			// b.N messages have been pulled without waiting out a poll.
+			go func() {
+				for i := 0; i < b.N+pullers; i++ {
+					c.Push(queue, "text/plain", strings.NewReader("x"))
+				}
+			}()
+
+			var pulled int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i := 0; i < pullers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						m, err := c.Pull(queue, time.Second)
+						if err != nil {
+							continue
+						}
+						c.Reply(m, ReplyAck)
+						if atomic.AddInt64(&pulled, 1) > int64(b.N) {
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
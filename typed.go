@@ -0,0 +1,105 @@
+package lmq
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedProducer pushes values of type T encoded as ContentType by the
+// registry of Client.
+type TypedProducer[T any] struct {
+	Client      Client
+	ContentType string
+}
+
+func NewTypedProducer[T any](c Client, contentType string) *TypedProducer[T] {
+	return &TypedProducer[T]{Client: c, ContentType: contentType}
+}
+
+func (p *TypedProducer[T]) Push(queue string, v T) (*PushResponse, error) {
+	return PushValue(p.Client, nil, queue, p.ContentType, v)
+}
+
+func (p *TypedProducer[T]) PushAll(queue string, v T) (map[string]*PushResponse, error) {
+	return PushAllValue(p.Client, nil, queue, p.ContentType, v)
+}
+
+// DecodeError is returned by TypedConsumer when a message cannot be decoded
+// into the type of the consumer.
+type DecodeError struct {
+	Queue string
+	ID    string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("lmq: cannot decode message %s of %s: %v", e.ID, e.Queue, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeErrorPolicy decides what happens to a message which cannot be
+// decoded. Its result is returned by the consumer, so a nil error acks the
+// message under the Replier middleware.
+type DecodeErrorPolicy func(context.Context, *Message, *DecodeError) error
+
+// NackOnDecodeError returns the decode error, so the message is nacked.
+func NackOnDecodeError(ctx context.Context, m *Message, err *DecodeError) error {
+	return err
+}
+
+// DeadLetter pushes messages which cannot be decoded to queue as they are and
+// acks them. The message is nacked if the push fails.
+func DeadLetter(c Client, queue string) DecodeErrorPolicy {
+	return func(ctx context.Context, m *Message, err *DecodeError) error {
+		return deadLetter(c, queue, m)
+	}
+}
+
+// TypedConsumer is a Handler which decodes messages into values of type T.
+// Normal messages are passed to Single and compound messages to Batch. If
+// either is nil, the other one is used instead: Batch receives a normal
+// message as a slice of length 1, and Single receives each part of a compound
+// message in turn.
+type TypedConsumer[T any] struct {
+	Single        func(context.Context, *Message, T) error
+	Batch         func(context.Context, *Message, []T) error
+	OnDecodeError DecodeErrorPolicy
+}
+
+func (c *TypedConsumer[T]) HandleMessage(ctx context.Context, m *Message) error {
+	var vs []T
+	for {
+		var v T
+		err := m.Decode(&v)
+		if err == EOF {
+			break
+		}
+		if err != nil {
+			return c.decodeError(ctx, m, err)
+		}
+		vs = append(vs, v)
+		if m.MessageType != "compound" {
+			break
+		}
+	}
+	if c.Batch != nil && (m.MessageType == "compound" || c.Single == nil) {
+		return c.Batch(ctx, m, vs)
+	}
+	for _, v := range vs {
+		if err := c.Single(ctx, m, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *TypedConsumer[T]) decodeError(ctx context.Context, m *Message, err error) error {
+	de := &DecodeError{Queue: m.Queue, ID: m.ID, Err: err}
+	if c.OnDecodeError == nil {
+		return NackOnDecodeError(ctx, m, de)
+	}
+	return c.OnDecodeError(ctx, m, de)
+}
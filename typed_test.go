@@ -0,0 +1,108 @@
+package lmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type order struct {
+	ID int
+}
+
+func TestTypedProducerConsumer(t *testing.T) {
+	queue := "TestTypedProducerConsumer"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	p := NewTypedProducer[order](c, "application/json")
+	_, err := p.Push(queue, order{ID: 1})
+	must(t, err)
+
+	var got []order
+	h := &TypedConsumer[order]{
+		Single: func(ctx context.Context, m *Message, v order) error {
+			got = append(got, v)
+			return nil
+		},
+	}
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	must(t, h.HandleMessage(context.Background(), m))
+	assert.Equal(t, []order{{ID: 1}}, got)
+}
+
+func TestTypedText(t *testing.T) {
+	queue := "TestTypedText"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	_, err := NewTypedProducer[string](c, "text/plain").Push(queue, "hello")
+	must(t, err)
+
+	var got []string
+	h := &TypedConsumer[string]{
+		Single: func(ctx context.Context, m *Message, v string) error {
+			got = append(got, v)
+			return nil
+		},
+	}
+	m, err := c.Pull(queue, 0)
+	must(t, err)
+	must(t, h.HandleMessage(context.Background(), m))
+	assert.Equal(t, []string{"hello"}, got)
+}
+
+func TestTypedConsumerCompound(t *testing.T) {
+	body, err := msgpackEncoder([][]interface{}{
+		{map[string]interface{}{"content-type": "application/json"}, []byte(`{"ID":1}`)},
+		{map[string]interface{}{"content-type": "application/json"}, []byte(`{"ID":2}`)},
+	})
+	must(t, err)
+
+	var batch []order
+	h := &TypedConsumer[order]{
+		Batch: func(ctx context.Context, m *Message, vs []order) error {
+			batch = vs
+			return nil
+		},
+	}
+	must(t, h.HandleMessage(context.Background(), &Message{MessageType: "compound", Body: body}))
+	assert.Equal(t, []order{{ID: 1}, {ID: 2}}, batch)
+
+	var single []order
+	h = &TypedConsumer[order]{
+		Single: func(ctx context.Context, m *Message, v order) error {
+			single = append(single, v)
+			return nil
+		},
+	}
+	must(t, h.HandleMessage(context.Background(), &Message{MessageType: "compound", Body: body}))
+	assert.Equal(t, []order{{ID: 1}, {ID: 2}}, single)
+}
+
+func TestTypedConsumerDecodeError(t *testing.T) {
+	h := &TypedConsumer[order]{
+		Single: func(ctx context.Context, m *Message, v order) error {
+			t.Fatal("unexpected call")
+			return nil
+		},
+	}
+	m := &Message{ID: "id", Queue: "q", MessageType: "normal", ContentType: "application/json", Body: []byte("{")}
+	err := h.HandleMessage(context.Background(), m)
+	var de *DecodeError
+	assert.True(t, errors.As(err, &de))
+	assert.Equal(t, ReplyNack, ReplyFor(err))
+
+	queue := "TestTypedConsumerDecodeError:dead"
+	c := New(lmqURL)
+	defer c.Delete(queue)
+	h.OnDecodeError = DeadLetter(c, queue)
+	m = &Message{ID: "id", Queue: "q", MessageType: "normal", ContentType: "application/json", Body: []byte("{")}
+	assert.Nil(t, h.HandleMessage(context.Background(), m))
+	dead, err := c.Pull(queue, 0)
+	must(t, err)
+	assert.Equal(t, "{", string(dead.Body))
+	assert.True(t, strings.HasPrefix(dead.ContentType, "application/json"))
+}
@@ -0,0 +1,97 @@
+package lmq
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrInvalidName = errors.New("lmq: invalid name")
+
+// MaxQueueNameLen is the maximum length of a queue name in bytes.
+const MaxQueueNameLen = 255
+
+// ValidateQueueName checks that name can be used as a queue name. A name is
+// non-empty UTF-8 of at most MaxQueueNameLen bytes without control
+// characters. It must not be "." or "..", which do not survive URL path
+// cleaning, nor start or end with white space, which does not survive the
+// X-Lmq-Queue-Name header. Any other character is escaped in URLs.
+func ValidateQueueName(name string) error {
+	switch {
+	case name == "":
+		return invalidName(name, "empty")
+	case len(name) > MaxQueueNameLen:
+		return invalidName(name, "too long")
+	case name == "." || name == "..":
+		return invalidName(name, "dot segment")
+	case strings.TrimSpace(name) != name:
+		return invalidName(name, "leading or trailing white space")
+	}
+	return validateChars(name)
+}
+
+func validateMessageID(id string) error {
+	if id == "" {
+		return invalidName(id, "empty message ID")
+	}
+	return validateChars(id)
+}
+
+func validateChars(s string) error {
+	if !utf8.ValidString(s) {
+		return invalidName(s, "not UTF-8")
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return invalidName(s, "control character")
+		}
+	}
+	return nil
+}
+
+func invalidName(name, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidName, name, reason)
+}
+
+// buildURL returns the path made of segments, each escaped as a whole so that
+// slashes and other special characters in queue names and message IDs are
+// kept, followed by query. All request URLs are built by it.
+func buildURL(query url.Values, segments ...string) string {
+	var b strings.Builder
+	for _, s := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(s))
+	}
+	if len(query) > 0 {
+		b.WriteByte('?')
+		b.WriteString(query.Encode())
+	}
+	return b.String()
+}
+
+func messagesURL(queue string, query url.Values) (string, error) {
+	if err := ValidateQueueName(queue); err != nil {
+		return "", err
+	}
+	return buildURL(query, "messages", queue), nil
+}
+
+func replyURL(queue, id string, r ReplyType) (string, error) {
+	if err := ValidateQueueName(queue); err != nil {
+		return "", err
+	}
+	if err := validateMessageID(id); err != nil {
+		return "", err
+	}
+	return buildURL(url.Values{"reply": {r.String()}}, "messages", queue, id), nil
+}
+
+func queueURL(prefix, queue string) (string, error) {
+	if err := ValidateQueueName(queue); err != nil {
+		return "", err
+	}
+	return buildURL(nil, prefix, queue), nil
+}